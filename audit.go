@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the audit log, for a mutating request or a state
+// change confirmed by the amplifier.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"` // "command" or "state"
+
+	// User is the HTTP auth user, and Remote the client address, of a
+	// command. Body is its request body, Status and Error its result.
+	User   string `json:"user,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Body   string `json:"body,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Amp is the amplifier name when there are several, Fields the changed
+	// state fields and State the new state, for a state change.
+	Amp    string          `json:"amp,omitempty"`
+	Fields []string        `json:"fields,omitempty"`
+	State  *AmplifierState `json:"state,omitempty"`
+}
+
+// auditLog appends the entries as JSON lines to a file, renamed with a .1
+// suffix, replacing the previous one, once it reaches maxSize bytes.
+type auditLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openAuditLog opens the audit log for appending, maxSize 0 disables the
+// rotation.
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file, l.mu must be held once the log is in use.
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// write appends the entry, errors are logged as the audit log must not fail
+// the requests.
+func (l *auditLog) write(e auditEntry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error, encoding audit entry: %v", err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(buf)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("error, rotating audit log %s: %v", l.path, err)
+		}
+	}
+	if l.f == nil {
+		return
+	}
+	n, err := l.f.Write(buf)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("error, writing audit log %s: %v", l.path, err)
+	}
+}
+
+// rotate renames the file and starts a new one, l.mu must be held.
+func (l *auditLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		// Keep appending to the current file.
+		if err := l.open(); err != nil {
+			return err
+		}
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the file.
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// withAudit writes an audit entry for each mutating request once served, with
+// its error if it failed. The body must be readable again, see withMaxBody.
+func withAudit(audit *auditLog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		rec := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		user, _, _ := r.BasicAuth()
+		e := auditEntry{
+			Time:   time.Now().UTC(),
+			Type:   "command",
+			User:   user,
+			Remote: r.RemoteAddr,
+			Method: r.Method,
+			Path:   r.URL.RequestURI(),
+			Body:   string(bytes.TrimSpace(body)),
+			Status: rec.code,
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if e.Status >= http.StatusBadRequest {
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(rec.body.Bytes(), &resp) == nil {
+				e.Error = resp.Error
+			}
+		}
+		audit.write(e)
+	})
+}
+
+// auditStateChanges writes an audit entry for each state change until ctx is
+// done, name is the amplifier name when there are several.
+func (a *Amplifier) auditStateChanges(ctx context.Context, audit *auditLog, name string) {
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case e := <-events:
+			if e.Type != eventState {
+				continue
+			}
+			audit.write(auditEntry{Time: time.Now().UTC(), Type: "state", Amp: name, Fields: e.Fields, State: e.State})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// readAudit returns the entries of the audit log.
+func readAudit(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	a, _ := newQueriedAmp(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.auditStateChanges(ctx, audit, "")
+	waitFor(t, "the audit subscription", func() bool {
+		a.subscribersMu.Lock()
+		defer a.subscribersMu.Unlock()
+		return len(a.subscribers) == 1
+	})
+	srv := httptest.NewServer(withAudit(audit, a.routes(false, false)))
+	defer srv.Close()
+
+	for _, body := range []string{`{"mute": "on"}`, `{"source": "nope"}`} {
+		req, _ := http.NewRequest("POST", srv.URL+"/status", strings.NewReader(body))
+		req.SetBasicAuth("alice", "secret")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	request(t, srv, "GET", "/status", "")
+
+	var commands, states []auditEntry
+	waitFor(t, "the audit entries", func() bool {
+		commands, states = nil, nil
+		for _, e := range readAudit(t, path) {
+			switch e.Type {
+			case "command":
+				commands = append(commands, e)
+			case "state":
+				states = append(states, e)
+			}
+		}
+		return len(commands) == 2 && len(states) == 1
+	})
+
+	if e := commands[0]; e.User != "alice" || e.Method != "POST" || e.Path != "/status" || e.Body != `{"mute": "on"}` || e.Status != 200 || e.Error != "" {
+		t.Errorf("Command entry = %+v, want alice muting", e)
+	}
+	if e := commands[1]; e.Status != 400 || !strings.Contains(e.Error, "nope") {
+		t.Errorf("Failed command entry = %+v, want the 400 with its error", e)
+	}
+	if e := states[0]; !slices.Contains(e.Fields, "mute") || e.State == nil || !e.State.Mute {
+		t.Errorf("State entry = %+v, want the mute change", e)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	for range 3 {
+		audit.write(auditEntry{Type: "command", Method: "POST", Path: "/mute/toggle", Status: 200})
+	}
+	if got := len(readAudit(t, path+".1")); got != 2 {
+		t.Errorf("%d entries in the rotated log, want 2", got)
+	}
+	if got := len(readAudit(t, path)); got != 1 {
+		t.Errorf("%d entries in the new log, want 1", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Batch step results
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+// stepResult is the outcome of a batch step.
+type stepResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runBatch applies the steps in order, stopping at the first error which is
+// returned with the results of every step. Other requests may be applied
+// between the steps.
+func (a *Amplifier) runBatch(ctx context.Context, steps []setRequest) ([]stepResult, error) {
+	requests := make([]*setRequest, len(steps))
+	for i := range steps {
+		requests[i] = &steps[i]
+	}
+	n, err := a.runSteps(ctx, requests)
+
+	results := make([]stepResult, len(steps))
+	for i := range results {
+		switch {
+		case i < n:
+			results[i].Status = stepOK
+		case i == n && err != nil:
+			results[i] = stepResult{Status: stepFailed, Error: err.Error()}
+		default:
+			results[i].Status = stepSkipped
+		}
+	}
+	if err != nil {
+		return results, fmt.Errorf("Step %d: %w", n+1, err)
+	}
+
+	return results, nil
+}
+
+// runSteps applies the batch or macro steps in order, stopping at the first
+// error. It returns the number of steps applied before it.
+func (a *Amplifier) runSteps(ctx context.Context, steps []*setRequest) (int, error) {
+	for i, step := range steps {
+		if err := a.apply(ctx, step); err != nil {
+			return i, err
+		}
+	}
+
+	return len(steps), nil
+}
+
+// serveBatch applies a list of changes in order, e.g. power, then source,
+// then mute, replying with the result of each step.
+func (a *Amplifier) serveBatch(w http.ResponseWriter, r *http.Request) {
+	var steps []setRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&steps); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(steps) == 0 {
+		writeError(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+	var errs []error
+	for i := range steps {
+		if err := steps[i].Validate(a); err != nil {
+			errs = append(errs, fmt.Errorf("Step %d: %v", i+1, strings.ReplaceAll(err.Error(), "\n", ", ")))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := a.runBatch(r.Context(), steps)
+
+	resp := struct {
+		Error   string       `json:"error,omitempty"`
+		Results []stepResult `json:"results"`
+	}{Results: results}
+	code := http.StatusOK
+	if err != nil {
+		resp.Error = err.Error()
+		code = errorStatus(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
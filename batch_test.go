@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// batchResponse is the reply of POST /batch.
+type batchResponse struct {
+	Error   string       `json:"error"`
+	Results []stepResult `json:"results"`
+}
+
+func TestBatch(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/batch", `[{"mute": "on"}, {"source": "D2"}, {"mute": "off"}]`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /batch = %d %s", resp.StatusCode, body)
+	}
+	var got batchResponse
+	json.Unmarshal([]byte(body), &got)
+	if want := (batchResponse{Results: []stepResult{{Status: stepOK}, {Status: stepOK}, {Status: stepOK}}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("POST /batch = %+v, want %+v", got, want)
+	}
+	if got, want := port.commands(), []Command{SetMuteOn, SetSourceD2, SetMuteOff}; !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+
+	for _, body := range []string{`[]`, `{"mute": "on"}`, `[{"mute": "on"}, {"source": "nope"}]`} {
+		if resp, out := request(t, srv, "POST", "/batch", body); resp.StatusCode != 400 {
+			t.Errorf("POST /batch %s = %d %s, want 400", body, resp.StatusCode, out)
+		}
+	}
+}
+
+func TestBatchFailure(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+	port.onCommand(func(c Command) []string {
+		if c == SetSourceD3 {
+			return []string{"#00,03"}
+		}
+		port.mu.Lock()
+		defer port.mu.Unlock()
+		return port.emulate(c)
+	})
+
+	resp, body := request(t, srv, "POST", "/batch", `[{"mute": "on"}, {"source": "D3"}, {"mute": "off"}]`)
+	if resp.StatusCode != 502 {
+		t.Errorf("POST /batch = %d %s, want 502", resp.StatusCode, body)
+	}
+	var got batchResponse
+	json.Unmarshal([]byte(body), &got)
+	if !strings.HasPrefix(got.Error, "Step 2: ") {
+		t.Errorf("Error = %q, want step 2", got.Error)
+	}
+	if len(got.Results) != 3 || got.Results[0].Status != stepOK || got.Results[1].Status != stepFailed || got.Results[1].Error == "" || got.Results[2].Status != stepSkipped {
+		t.Errorf("Results = %+v, want ok, failed then skipped", got.Results)
+	}
+	if got, want := port.commands(), []Command{SetMuteOn, SetSourceD3}; !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+}
@@ -1,24 +1,121 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
 	"go.bug.st/serial"
+	"golang.org/x/time/rate"
 )
 
 var (
-	port = flag.String("port", "/dev/ttyUSB0", "Serial port")
-	user = flag.String("user", "", "HTTP auth username")
-	pwd  = flag.String("pwd", "", "HTTP auth password")
+	port   = flag.String("port", "/dev/ttyUSB0", "Serial port, or tcp://host:port for a serial to network bridge")
+	listen = flag.String("listen", ":8080", "HTTP listen address, e.g. 127.0.0.1:9000, [::1]:9000 or unix:/run/cxa81.sock")
+	model  = flag.String("model", "CXA81", "Amplifier model: CXA61 or CXA81, used unless the amplifier reports it with -extended-queries")
+	user   = flag.String("user", "", "HTTP auth username, /healthz and /metrics are served without auth")
+	pwd    = flag.String("pwd", "", "HTTP auth password")
+
+	openAttempts = flag.Int("open-attempts", 10, "Attempts to open the serial port at startup while it doesn't exist")
+	openInterval = flag.Duration("open-interval", 2*time.Second, "Interval between attempts to open the serial port")
+
+	logLevel = flag.String("log-level", "info", "Logging level: info, or debug adding the bytes written to and read from the serial port")
+
+	readTimeout = flag.Duration("read-timeout", time.Second, "Serial port read timeout (0 blocks indefinitely)")
+	lineEnding  = flag.String("line-ending", "cr", "Line termination of commands and replies: cr, lf or crlf, for bridges translating it")
+
+	pollInterval = flag.Duration("poll-interval", 0, "Interval between state queries (0 disables polling)")
+	jitter       = flag.Float64("jitter", 0.1, "Random fraction by which the poll and reconnect intervals vary")
+	watchdog     = flag.Duration("watchdog", 0, "Reopen the serial port when a command got no reply within this window, best with -poll-interval (0 disables)")
+
+	reconnectInitial = flag.Duration("reconnect-initial", defaultReconnectInitial, "Delay before the first attempt to reopen the serial port after an error")
+	reconnectMax     = flag.Duration("reconnect-max", defaultReconnectMax, "Maximum delay between attempts to reopen the serial port")
+	reconnectFactor  = flag.Float64("reconnect-factor", defaultReconnectFactor, "Factor by which the reconnect delay grows after each failed attempt, 1 retries at a constant interval")
+
+	commandGap   = flag.Duration("command-gap", 50*time.Millisecond, "Minimum delay between consecutive commands")
+	dryRun       = flag.Bool("dry-run", false, "Log commands instead of writing them to the serial port")
+	writeRetries = flag.Int("write-retries", 2, "Number of times a failed serial write is retried")
+
+	confirmTimeout = flag.Duration("confirm-timeout", 500*time.Millisecond, "How long to wait for the amplifier to confirm a command")
+
+	queryRetryDeadline = flag.Duration("query-retry-deadline", 10*time.Second, "How long state queries rejected by the amplifier are retried, e.g. while it's waking at startup (0 disables)")
+	extendedQueries    = flag.Bool("extended-queries", false, "Also query the tone, speakers, settings, protection and identity, whose commands aren't in the published protocol and may be unknown to the amplifier")
+
+	standbyMode = flag.String("standby", "reject", "Handling of mute, source and tone changes in standby: reject or wake")
+
+	alwaysSend = flag.Bool("always-send", false, "Send commands even when the amplifier already reports the requested value")
+
+	keepStateOnOff = flag.Bool("keep-state-on-off", false, "Keep the last known mute and source in standby rather than clearing them, they are stale while power is off")
+
+	autoOff = flag.Duration("auto-off", 0, "Put the amplifier in standby after this long without commands (0 disables)")
+
+	sourceDebounce = flag.Duration("source-debounce", 300*time.Millisecond, "Collapse source changes within this window to the last one, replying to them once it's confirmed")
+
+	verifySource = flag.Bool("verify-source", false, "Query the source after changing it, retrying once when the amplifier landed on another one")
+
+	selfTest      = flag.Bool("selftest", false, "Check the amplifier replies at startup, logging the result")
+	selfTestFatal = flag.Bool("selftest-fatal", false, "Run the -selftest check, exiting with an error when it fails, e.g. for init scripts")
+
+	enableRaw = flag.Bool("enable-raw", false, "Enable the raw /command endpoint")
+	enableUI  = flag.Bool("ui", false, "Serve the web UI at /")
+
+	cmd     = flag.String("cmd", "", "Send a single command (e.g. power:on, source:D2, mute:toggle) and exit")
+	cmdWait = flag.Duration("cmd-wait", time.Second, "Time to wait for replies in -cmd mode")
+
+	tlsCert       = flag.String("tls-cert", "", "TLS certificate file")
+	tlsKey        = flag.String("tls-key", "", "TLS key file")
+	tlsSelfSigned = flag.Bool("tls-self-signed", false, "Serve TLS with a generated self-signed certificate")
+
+	corsOrigin = flag.String("cors-origin", "", "Allowed CORS origin, or * for any (disabled when empty)")
+
+	rateLimit = flag.Float64("rate-limit", 5, "Maximum mutating requests per second (0 disables)")
+	rateBurst = flag.Int("rate-burst", 10, "Burst of mutating requests allowed above -rate-limit")
+
+	jsonStyle = flag.String("json-style", jsonCamel, "JSON field names style: camel, e.g. speakerOutput, or snake, e.g. speaker_output")
+
+	idempotencyTTL = flag.Duration("idempotency-ttl", 5*time.Minute, "How long the response to a mutating request with an Idempotency-Key header is replayed for repeats of the key (0 disables)")
+
+	maxBody = flag.Int64("max-body", 4096, "Maximum size in bytes of the body of POST and PUT requests")
+
+	userCooldown = flag.Duration("user-cooldown", 0, "Minimum interval between the mutating requests of each HTTP auth user, shared when auth is off (0 disables)")
+
+	historySize = flag.Int("history-size", defaultHistorySize, "Number of replies kept for GET /log")
+
+	auditLogFile    = flag.String("audit-log", "", "File the mutating requests and state changes are appended to as JSON lines, apart from the operational log")
+	auditLogMaxSize = flag.Int64("audit-log-max-size", 10<<20, "Size in bytes at which the audit log is renamed with a .1 suffix and a new one started (0 disables rotation)")
+
+	stateFile = flag.String("state-file", "", "File the state is saved to on shutdown and loaded from at startup")
+
+	healthStale = flag.Duration("healthz-stale", 0, "Report unhealthy when no reply was received within this window (0 disables)")
 )
 
+// version is the program version, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
 // Command represents a serial command to the CXA amplifier.
 type Command struct {
 	Group  string
@@ -26,6 +123,31 @@ type Command struct {
 	Data   string
 }
 
+var (
+	validCode = regexp.MustCompile(`^\d\d$`)
+	validData = regexp.MustCompile(`^[0-9A-Za-z+.-]*$`)
+)
+
+// Validate checks the command is well formed before it's sent to the
+// amplifier, in particular that the data can't end the command and inject
+// another one.
+func (c Command) Validate() error {
+	if !validCode.MatchString(c.Group) {
+		return fmt.Errorf("Invalid command group %q, expected two digits", c.Group)
+	}
+	if !validCode.MatchString(c.Number) {
+		return fmt.Errorf("Invalid command number %q, expected two digits", c.Number)
+	}
+	if strings.ContainsAny(c.Data, "#,") || strings.ContainsFunc(c.Data, unicode.IsControl) {
+		return fmt.Errorf("Invalid command data %q, delimiters and control characters aren't allowed", c.Data)
+	}
+	if !validData.MatchString(c.Data) {
+		return fmt.Errorf("Invalid command data %q", c.Data)
+	}
+
+	return nil
+}
+
 // Amplifier Commands
 var (
 	GetPowerState   = Command{Group: "01", Number: "01"}
@@ -36,6 +158,99 @@ var (
 	SetMuteOn       = Command{Group: "01", Number: "04", Data: "1"}
 )
 
+// Speaker Commands, not in the published protocol, which only covers
+// power, mute, source and versions, so only queried with -extended-queries.
+var (
+	GetSpeakerOutput = Command{Group: "01", Number: "24"}
+	SetSpeakerA      = Command{Group: "01", Number: "25", Data: "0"}
+	SetSpeakerAB     = Command{Group: "01", Number: "25", Data: "1"}
+	SetSpeakerB      = Command{Group: "01", Number: "25", Data: "2"}
+
+	GetHeadphonesState = Command{Group: "01", Number: "26"}
+	GetSpeakersState   = Command{Group: "01", Number: "27"}
+)
+
+// Display Commands, unverified, see the speaker commands.
+var (
+	GetDisplayBrightness = Command{Group: "01", Number: "28"}
+)
+
+// Settings Commands, unverified, see the speaker commands.
+var (
+	GetAutoPowerDown = Command{Group: "01", Number: "30"}
+	GetStartupVolume = Command{Group: "01", Number: "32"}
+	GetMaxVolume     = Command{Group: "01", Number: "34"}
+)
+
+// Protection Commands, unverified, see the speaker commands.
+var (
+	GetProtectionStatus = Command{Group: "01", Number: "36"}
+	GetTemperature      = Command{Group: "01", Number: "37"}
+)
+
+// Protection states, anything but None means the outputs are shut down.
+var protectionStates = map[string]string{
+	"0": "None",
+	"1": "Overtemperature",
+	"2": "DC offset",
+	"3": "Short circuit",
+}
+
+// Volume settings range, in percent of the full volume.
+const (
+	minVolume = 0
+	maxVolume = 100
+)
+
+// SetStartupVolume returns the command setting the volume the amplifier
+// starts at when powered on.
+func SetStartupVolume(level int) (Command, error) {
+	if level < minVolume || level > maxVolume {
+		return Command{}, fmt.Errorf("Startup volume %d out of range, expected: %d to %d", level, minVolume, maxVolume)
+	}
+	return Command{Group: "01", Number: "33", Data: strconv.Itoa(level)}, nil
+}
+
+// SetMaxVolume returns the command setting the volume the amplifier can't be
+// turned above.
+func SetMaxVolume(level int) (Command, error) {
+	if level < minVolume || level > maxVolume {
+		return Command{}, fmt.Errorf("Max volume %d out of range, expected: %d to %d", level, minVolume, maxVolume)
+	}
+	return Command{Group: "01", Number: "35", Data: strconv.Itoa(level)}, nil
+}
+
+// SetAutoPowerDown returns the command enabling or disabling the automatic
+// standby after 20 minutes without signal.
+func SetAutoPowerDown(enabled bool) Command {
+	c := Command{Group: "01", Number: "31", Data: "0"}
+	if enabled {
+		c.Data = "1"
+	}
+	return c
+}
+
+// Auto power down states
+var autoPowerDownStates = map[string]string{
+	"0": "Disabled",
+	"1": "Enabled",
+}
+
+// Display brightness range, from off to full brightness.
+const (
+	minBrightness = 0
+	maxBrightness = 2
+)
+
+// SetDisplayBrightness returns the command setting the front panel display
+// brightness to the given level.
+func SetDisplayBrightness(level int) (Command, error) {
+	if level < minBrightness || level > maxBrightness {
+		return Command{}, fmt.Errorf("Display brightness %d out of range, expected: %d to %d", level, minBrightness, maxBrightness)
+	}
+	return Command{Group: "01", Number: "29", Data: strconv.Itoa(level)}, nil
+}
+
 // Source Commands
 var (
 	GetSource           = Command{Group: "03", Number: "01"}
@@ -54,363 +269,2291 @@ var (
 	SetSourceA1Balanced = Command{Group: "03", Number: "04", Data: "20"}
 )
 
+// Tone Commands, unverified, see the speaker commands.
+var (
+	GetBass    = Command{Group: "05", Number: "01"}
+	GetTreble  = Command{Group: "05", Number: "03"}
+	GetBalance = Command{Group: "05", Number: "05"}
+)
+
+// Tone adjustment ranges accepted by the amplifier.
+const (
+	minTone    = -10
+	maxTone    = 10
+	minBalance = -15
+	maxBalance = 15
+)
+
+// SetBass returns the command setting the bass to the given level.
+func SetBass(level int) (Command, error) {
+	if level < minTone || level > maxTone {
+		return Command{}, fmt.Errorf("Bass %d out of range, expected: %d to %d", level, minTone, maxTone)
+	}
+	return Command{Group: "05", Number: "02", Data: strconv.Itoa(level)}, nil
+}
+
+// SetTreble returns the command setting the treble to the given level.
+func SetTreble(level int) (Command, error) {
+	if level < minTone || level > maxTone {
+		return Command{}, fmt.Errorf("Treble %d out of range, expected: %d to %d", level, minTone, maxTone)
+	}
+	return Command{Group: "05", Number: "04", Data: strconv.Itoa(level)}, nil
+}
+
+// SetBalance returns the command setting the balance to the given level,
+// negative values shift towards the left channel.
+func SetBalance(level int) (Command, error) {
+	if level < minBalance || level > maxBalance {
+		return Command{}, fmt.Errorf("Balance %d out of range, expected: %d to %d", level, minBalance, maxBalance)
+	}
+	return Command{Group: "05", Number: "06", Data: strconv.Itoa(level)}, nil
+}
+
+// Bluetooth Commands
+var (
+	SetBluetoothPairing = Command{Group: "03", Number: "07"}
+)
+
+// Bluetooth pairing states
+var pairingStates = map[string]string{
+	"0": "Not pairing",
+	"1": "Pairing",
+}
+
+// Source trim range accepted by the amplifier.
+const (
+	minTrim = -6
+	maxTrim = 6
+)
+
+// GetSourceTrim returns the command querying the trim of the source.
+func GetSourceTrim(src Source) Command {
+	return Command{Group: "03", Number: "05", Data: src.Code}
+}
+
+// SetSourceTrim returns the command setting the trim of the source to the
+// given level, sent as the source code followed by the signed level.
+func SetSourceTrim(src Source, level int) (Command, error) {
+	if level < minTrim || level > maxTrim {
+		return Command{}, fmt.Errorf("Trim %d out of range, expected: %d to %d", level, minTrim, maxTrim)
+	}
+	return Command{Group: "03", Number: "06", Data: fmt.Sprintf("%s%+d", src.Code, level)}, nil
+}
+
+// parseTrim decodes the data of a source trim reply.
+func parseTrim(data string) (source string, level int, err error) {
+	if len(data) < 3 {
+		return "", 0, &ErrInvalidReply{Reason: "source trim", Data: data}
+	}
+	source, ok := sources[data[:2]]
+	if !ok {
+		return "", 0, &ErrInvalidReply{Reason: "source trim", Data: data}
+	}
+	level, err = strconv.Atoi(data[2:])
+	if err != nil {
+		return "", 0, &ErrInvalidReply{Reason: "source trim", Data: data}
+	}
+	return source, level, nil
+}
+
 // Version Commands
 var (
 	GetProtocolVersion = Command{Group: "13", Number: "01"}
 	GetFirmwareVersion = Command{Group: "13", Number: "02"}
 )
 
-// Sources
-var sources = map[string]string{
-	"00": "A1",
-	"01": "A2",
-	"02": "A3",
-	"03": "A4",
-	"04": "D1",
-	"05": "D2",
-	"06": "D3",
-	"10": "MP3", // CXA81 only
-	"14": "Bluetooth",
-	"16": "USB",
-	"20": "A1 Balanced",
+// Identity Commands, unverified, see the speaker commands.
+var (
+	GetModel        = Command{Group: "13", Number: "03"}
+	GetSerialNumber = Command{Group: "13", Number: "04"}
+)
+
+// detectModel returns the model matching the one reported by the amplifier,
+// e.g. CXA81 for "CXA81 MkII".
+func detectModel(reported string) (string, bool) {
+	name := strings.ToUpper(strings.ReplaceAll(reported, " ", ""))
+	for _, model := range []string{CXA61, CXA81} {
+		if strings.HasPrefix(name, model) {
+			return model, true
+		}
+	}
+	return "", false
+}
+
+// Source describes an amplifier input.
+type Source struct {
+	Code      string
+	Name      string
+	Command   Command
+	CXA81Only bool
+}
+
+// Models
+const (
+	CXA61 = "CXA61"
+	CXA81 = "CXA81"
+)
+
+// availableOn reports whether the source exists on the given model.
+func (s Source) availableOn(model string) bool {
+	return !s.CXA81Only || model == CXA81
+}
+
+// sourceTable is the single source of truth for the amplifier inputs.
+var sourceTable = []Source{
+	{Code: "00", Name: "A1", Command: SetSourceA1},
+	{Code: "01", Name: "A2", Command: SetSourceA2},
+	{Code: "02", Name: "A3", Command: SetSourceA3},
+	{Code: "03", Name: "A4", Command: SetSourceA4},
+	{Code: "04", Name: "D1", Command: SetSourceD1},
+	{Code: "05", Name: "D2", Command: SetSourceD2},
+	{Code: "06", Name: "D3", Command: SetSourceD3},
+	{Code: "10", Name: "MP3", Command: SetSourceMP3, CXA81Only: true},
+	{Code: "14", Name: "Bluetooth", Command: SetSourceBluetooth},
+	{Code: "16", Name: "USB", Command: SetSourceUSBAudio, CXA81Only: true},
+	{Code: "20", Name: "A1 Balanced", Command: SetSourceA1Balanced, CXA81Only: true},
+}
+
+// Sources by code and by lower case name, derived from sourceTable.
+var (
+	sources       = make(map[string]string)
+	sourcesByName = make(map[string]Source)
+)
+
+func init() {
+	for _, src := range sourceTable {
+		sources[src.Code] = src.Name
+		sourcesByName[strings.ToLower(src.Name)] = src
+	}
+}
+
+// sourceAliases maps alternative lower case names to source names.
+var sourceAliases = map[string]string{
+	"bt":          "Bluetooth",
+	"usb audio":   "USB",
+	"usbaudio":    "USB",
+	"balanced":    "A1 Balanced",
+	"a1balanced":  "A1 Balanced",
+	"a1 bal":      "A1 Balanced",
+	"a1-balanced": "A1 Balanced",
+}
+
+// lookupSource finds a source by name or alias, ignoring case and surrounding
+// spaces.
+func lookupSource(s string) (Source, bool) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	if name, ok := sourceAliases[key]; ok {
+		key = strings.ToLower(name)
+	}
+	src, ok := sourcesByName[key]
+	return src, ok
+}
+
+// Power states
+var powerStates = map[string]string{
+	"0": "Standby",
+	"1": "On",
+}
+
+// Mute states
+var muteStates = map[string]string{
+	"0": "Off",
+	"1": "On",
+}
+
+// Speaker outputs
+var speakerOutputs = map[string]string{
+	"0": "A",
+	"1": "AB",
+	"2": "B",
+}
+
+// Headphones and speakers connection states
+var connectionStates = map[string]string{
+	"0": "Disconnected",
+	"1": "Connected",
 }
 
 // Reply represents a reply from the CXA amplifier.
 type Reply struct {
-	Group  string
-	Number string
-	Data   string
+	Group  string `json:"group"`
+	Number string `json:"number"`
+	Data   string `json:"data,omitempty"`
 }
 
-var validReply = regexp.MustCompile(`#(\d\d),(\d\d)(?:,([^\r]*))?\r`)
+var validReply = regexp.MustCompile(`^#(\d\d),(\d\d)(?:,([^\r]*))?$`)
 
 func (r *Reply) String() string {
-	desc := fmt.Sprintf("Unknown reply: %s,%s,%s", r.Group, r.Number, r.Data)
-	data := r.Data
-
-	switch r.Group {
-	case "00":
-		switch r.Number {
-		case "01":
-			desc = "Command group unknown"
-		case "02":
-			desc = "Command number unknown"
-		case "03":
-			desc = "Command data error"
-		case "04":
-			desc = "Command not available"
-		}
-	case "02":
-		switch r.Number {
-		case "01":
-			desc = "Current power state"
-		case "03":
-			desc = "Current mute state"
-		}
-	case "04":
-		if r.Number == "01" {
-			desc = "Current source"
-			data = sources[data]
-		}
-	case "14":
-		switch r.Number {
-		case "01":
-			desc = "Protocol Version"
-		case "02":
-			desc = "Get Firmware Version"
-		}
-	}
-
-	if r.Data != "" {
-		return fmt.Sprintf("%s: %s", desc, r.Data)
+	desc, data := r.describe()
+	if desc == "" {
+		return fmt.Sprintf("Unknown reply: %s,%s,%s", r.Group, r.Number, r.Data)
+	}
+	if data != "" {
+		return fmt.Sprintf("%s: %s", desc, data)
 	}
 
 	return desc
 }
 
+// modeled reports whether the reply is one the amplifier state handles, or an
+// error, rather than a well formed reply this code doesn't know about.
+func (r *Reply) modeled() bool {
+	desc, _ := r.describe()
+	return desc != ""
+}
+
+// describe returns the description of the reply and its decoded data, the
+// description is empty for unknown replies.
+func (r *Reply) describe() (desc, data string) {
+	h, ok := replyHandlers[[2]string{r.Group, r.Number}]
+	if !ok {
+		return "", r.Data
+	}
+	if h.decode != nil {
+		return h.desc, h.decode(r.Data)
+	}
+	return h.desc, r.Data
+}
+
 // AmplifierState represents the internal state of the amplifier.
 type AmplifierState struct {
-	Power  bool   `json:"power"`
-	Mute   bool   `json:"mute"`
-	Source string `json:"source"`
+	Power   bool   `json:"power"`
+	Mute    bool   `json:"mute"`
+	Source  string `json:"source"`
+	Bass    int    `json:"bass"`
+	Treble  int    `json:"treble"`
+	Balance int    `json:"balance"`
+
+	// Trims are the source trims by source name, once queried or set.
+	Trims map[string]int `json:"trims,omitempty"`
+
+	// BluetoothPairing is set while the Bluetooth input is discoverable.
+	BluetoothPairing bool `json:"bluetoothPairing"`
+
+	SpeakerOutput       string `json:"speakerOutput"`
+	HeadphonesConnected bool   `json:"headphonesConnected"`
+	SpeakersConnected   bool   `json:"speakersConnected"`
+
+	// AutoPowerDown is set when the amplifier goes to standby by itself
+	// after 20 minutes without signal.
+	AutoPowerDown bool `json:"autoPowerDown"`
+
+	// StartupVolume and MaxVolume are the volume settings, once queried or
+	// set.
+	StartupVolume *int `json:"startupVolume,omitempty"`
+	MaxVolume     *int `json:"maxVolume,omitempty"`
+
+	// DisplayBrightness is the front panel brightness, once queried or set.
+	DisplayBrightness *int `json:"displayBrightness,omitempty"`
+
+	// Protection is the engaged protection, None in normal operation, and
+	// Temperature the amplifier temperature in °C, once reported.
+	Protection  string `json:"protection,omitempty"`
+	Temperature *int   `json:"temperature,omitempty"`
+
+	ProtocolVersion string `json:"protocolVersion"`
+	FirmwareVersion string `json:"firmwareVersion"`
+
+	// Model and SerialNumber are as reported by the amplifier, if it does.
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// When the power, mute and source last changed, nil until they do.
+	PowerChangedAt  *time.Time `json:"powerChangedAt,omitempty"`
+	MuteChangedAt   *time.Time `json:"muteChangedAt,omitempty"`
+	SourceChangedAt *time.Time `json:"sourceChangedAt,omitempty"`
 }
 
 // Amplifier represents the CXA amplifier and its serial connection.
 type Amplifier struct {
-	port io.ReadWriteCloser
+	// port is replaced by Listen when reconnecting, under portMu which the
+	// writers and the goroutines closing it hold to read it. Closing it
+	// doesn't wait for writeMu, held by a write which may be blocked.
+	port   io.ReadWriteCloser
+	portMu sync.Mutex
+
+	// model selects the sources available on the amplifier.
+	model string
+
+	// healthStale is how long without replies before the health probe
+	// fails, 0 disables the check.
+	healthStale time.Duration
+
+	// writeMu guards lastWrite, which is used to keep commands at least
+	// commandGap apart, writeStarted, when the last write started as its
+	// reply can be read before it returns, and inflight which is closed once
+	// the last write completed.
+	writeMu      sync.Mutex
+	lastWrite    time.Time
+	writeStarted time.Time
+	commandGap   time.Duration
+	inflight     chan struct{}
 
+	// dryRun logs the commands instead of writing them, simulating the
+	// replies from dryRunState, guarded by dryRunMu.
+	dryRun      bool
+	dryRunMu    sync.Mutex
+	dryRunState map[[2]string]string
+
+	// debug logs the raw serial traffic.
+	debug bool
+
+	// writeRetries is the number of times a transient write error is
+	// retried.
+	writeRetries int
+
+	// confirmTimeout is how long handlers wait for the amplifier to confirm
+	// a command.
+	confirmTimeout time.Duration
+
+	// queryRetryDeadline bounds the retries of rejected state queries.
+	queryRetryDeadline time.Duration
+
+	// extendedQueries adds the queries beyond the published protocol, see
+	// unverifiedQueries.
+	extendedQueries bool
+
+	// wakeOnChange powers the amplifier on for changes requested in standby
+	// instead of rejecting them.
+	wakeOnChange bool
+
+	// cmdMu serializes the commands awaiting a reply, from the write to the
+	// matching of the reply, as the amplifier's error replies don't tell
+	// which command they are for. It's only held for one command at a time
+	// so that a slow request doesn't hold up the others.
+	cmdMu sync.Mutex
+
+	// sourceDebounce delays source commands so that rapid changes only
+	// switch the relays once, sourceMu guards pendingSource and its timer.
+	sourceDebounce time.Duration
+	verifySource   bool
+	sourceMu       sync.Mutex
+	pendingSource  *sourceFlush
+	sourceTimer    Timer
+
+	// sleepMu guards the sleep timer, which puts the amplifier in standby
+	// after sleepIdle without commands, from -auto-off until POST /sleep
+	// replaces it.
+	sleepMu    sync.Mutex
+	sleepIdle  time.Duration
+	sleepTimer Timer
+	sleepAt    time.Time
+
+	// alwaysSend disables skipping commands for values the amplifier already
+	// reports.
+	alwaysSend bool
+
+	// keepStateOnOff keeps the mute and source state in standby.
+	keepStateOnOff bool
+
+	// mu guards state, which is only updated from the amplifier replies, and
+	// known which records the state fields confirmed by a reply.
 	mu    sync.Mutex
 	state AmplifierState
+	known map[string]bool
+
+	// changed is closed on the next state update, also guarded by mu.
+	changed chan struct{}
+
+	// sourceSwitchedAt and muteRequestedAt tell the mute the amplifier
+	// applies while switching sources from a requested one, muteCheck
+	// queries the mute state once the switch is over. Also guarded by mu.
+	sourceSwitchedAt time.Time
+	muteRequestedAt  time.Time
+	muteCheck        Timer
+
+	// portName and readTimeout are used to reopen the port. The Listen
+	// goroutine is the only one reading the port and framing the replies,
+	// writes are serialized by writeMu. The serial line is full duplex so
+	// a write can't split a reply being read, the port is only replaced by
+	// Listen and closed by it, the Watchdog or Close while holding portMu.
+	portName    string
+	readTimeout time.Duration
+
+	// terminator ends the commands and replies, \r unless the bridge
+	// translates it.
+	terminator string
+
+	// cancel stops the goroutines started by Start, tracked by wg.
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+
+	// pollInterval and reconnections are spread by jitter.
+	pollInterval time.Duration
+	jitter       float64
+
+	// watchdog is how long without a reply to a command before the port
+	// is reopened, 0 disables it.
+	watchdog time.Duration
+
+	// The reconnect delay grows by reconnectFactor, up to reconnectMax.
+	reconnectInitial time.Duration
+	reconnectMax     time.Duration
+	reconnectFactor  float64
+
+	// connMu guards the connection status and last error.
+	connMu     sync.Mutex
+	connStatus string
+	connErr    string
+
+	// partial holds the start of a reply split across reads, it's only used
+	// by the Listen goroutine.
+	partial []byte
+
+	// lastReplyTime is read by the health probe without taking mu.
+	lastReplyTime atomic.Int64 // Unix nanoseconds
+
+	watchersMu sync.Mutex
+	watchers   map[chan *Reply]struct{}
+
+	// subscribers receive the events, see Subscribe.
+	subscribersMu sync.Mutex
+	subscribers   map[chan Event]struct{}
+
+	// streamsDone is closed by stopStreams.
+	streamsDone chan struct{}
+	streamsOnce sync.Once
+
+	history *replyHistory
+
+	metrics  ampMetrics
+	parseLog *logLimiter
+
+	refreshMu  sync.Mutex
+	refreshing *refreshCall
+
+	// clock drives the timers, a FakeClock in tests.
+	clock Clock
+
+	// rules allow or deny changes.
+	rules commandRules
+
+	// macros are the named sequences of changes run by POST /macro/<name>.
+	macros map[string][]MacroStep
+
+	// stateFile persists the state across restarts when set.
+	stateFile string
+
+	// labels are the user's names for the sources, by source name.
+	labels map[string]string
 }
 
-// NewAmplifier creates a new Amplifier instance.
-func NewAmplifier(portName string) (*Amplifier, error) {
-	mode := &serial.Mode{
-		BaudRate: 9600,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
+// NewAmplifier creates a new Amplifier instance from the configuration.
+func NewAmplifier(cfg *Config) (*Amplifier, error) {
+	a := &Amplifier{
+		portName:     cfg.Port,
+		readTimeout:  cfg.ReadTimeout,
+		terminator:   lineEndings[cfg.LineEnding],
+		pollInterval: cfg.PollInterval,
+		jitter:       cfg.Jitter,
+		watchdog:     cfg.Watchdog,
+
+		reconnectInitial: cfg.ReconnectInitial,
+		reconnectMax:     cfg.ReconnectMax,
+		reconnectFactor:  cfg.ReconnectFactor,
+
+		model:          cfg.Model,
+		healthStale:    cfg.HealthzStale,
+		commandGap:     cfg.CommandGap,
+		writeRetries:   cfg.WriteRetries,
+		confirmTimeout: cfg.ConfirmTimeout,
+
+		queryRetryDeadline: cfg.QueryRetryDeadline,
+		extendedQueries:    cfg.ExtendedQueries,
+		wakeOnChange:       cfg.Standby == "wake",
+		sourceDebounce:     cfg.SourceDebounce,
+		verifySource:       cfg.VerifySource,
+		alwaysSend:         cfg.AlwaysSend,
+		keepStateOnOff:     cfg.KeepStateOnOff,
+		dryRun:             cfg.DryRun,
+		debug:              cfg.LogLevel == "debug",
+		sleepIdle:          cfg.AutoOff,
+		history:            newReplyHistory(cfg.HistorySize),
+		parseLog:           &logLimiter{interval: parseErrorInterval, clock: realClock{}},
+		macros:             cfg.Macros,
+		clock:              realClock{},
+		streamsDone:        make(chan struct{}),
 	}
 
-	port, err := serial.Open(portName, mode)
+	labels, err := parseLabels(cfg.Labels)
 	if err != nil {
 		return nil, err
 	}
+	a.labels = labels
+	if a.rules, err = parseRules(cfg.Allow, cfg.Deny); err != nil {
+		return nil, err
+	}
 
-	return &Amplifier{port: port}, nil
-}
-
-// SendCommand sends a command to the amplifier.
-func (a *Amplifier) SendCommand(cmd Command) error {
-	s := fmt.Sprintf("#%s,%s", cmd.Group, cmd.Number)
-	if cmd.Data != "" {
-		s += fmt.Sprintf(",%s\r", cmd.Data)
-	} else {
-		s += "\r"
+	if cfg.StateFile != "" {
+		a.stateFile = cfg.StateFile
+		st, err := loadState(cfg.StateFile)
+		switch {
+		case err == nil:
+			a.state = st
+		case errors.Is(err, fs.ErrNotExist):
+		default:
+			log.Printf("warning, ignoring state file %s: %v", cfg.StateFile, err)
+		}
 	}
 
-	_, err := a.port.Write([]byte(s))
+	port, err := a.openSerial(cfg.OpenAttempts, cfg.OpenInterval)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	a.port = port
+	a.setConnection(connConnected, nil)
 
-	return nil
+	return a, nil
 }
 
-// readUpdate reads from the port and updates the state accordingly.
-func (a *Amplifier) readUpdate() error {
-	buf := make([]byte, 1024)
+// NewAmplifierWithPort creates a new Amplifier instance using an already open
+// port, e.g. a fake one in tests. The port can't be reopened on errors.
+func NewAmplifierWithPort(port io.ReadWriteCloser) *Amplifier {
+	a := &Amplifier{
+		port:       port,
+		model:      CXA81,
+		terminator: lineEndings["cr"],
 
-	n, err := a.port.Read(buf)
-	if err != nil {
-		return err
-	}
+		reconnectInitial: defaultReconnectInitial,
+		reconnectMax:     defaultReconnectMax,
+		reconnectFactor:  defaultReconnectFactor,
 
-	response := string(buf[:n])
-	log.Printf("Debug: response from amp %q", response)
-	matches := validReply.FindAllStringSubmatch(response, -1)
-	if matches == nil {
-		return fmt.Errorf("invalid reply format: %q", response)
+		confirmTimeout: 500 * time.Millisecond,
+		history:        newReplyHistory(defaultHistorySize),
+		parseLog:       &logLimiter{interval: parseErrorInterval, clock: realClock{}},
+		clock:          realClock{},
+		streamsDone:    make(chan struct{}),
 	}
+	a.setConnection(connConnected, nil)
 
-	for _, m := range matches {
-		reply := &Reply{
-			Group:  m[1],
-			Number: m[2],
-		}
-		// If data is present, capture it
-		if len(m) > 3 {
-			reply.Data = m[3]
-		}
-		log.Printf("Received: %v", reply)
-		a.UpdateState(reply)
-	}
-	return nil
+	return a
 }
 
-// Listen calls readUpdate indefinitely.
-func (a *Amplifier) Listen() {
-	for {
-		if err := a.readUpdate(); err != nil {
-			log.Printf("error, readUpdate(): %v", err)
-			continue
-		}
+// stateQueries are the queries for the amplifier state.
+var stateQueries = []Command{
+	GetPowerState,
+	GetMuteState,
+	GetSource,
+}
+
+// unverifiedQueries are the queries for the rest of the state, added to
+// stateQueries with -extended-queries as they may be unknown to the
+// amplifier.
+var unverifiedQueries = []Command{
+	GetBass,
+	GetTreble,
+	GetBalance,
+	GetSpeakerOutput,
+	GetHeadphonesState,
+	GetSpeakersState,
+	GetAutoPowerDown,
+	GetProtectionStatus,
+	GetTemperature,
+}
+
+// stateQueries returns the queries for the amplifier state.
+func (a *Amplifier) stateQueries() []Command {
+	if a.extendedQueries {
+		return slices.Concat(stateQueries, unverifiedQueries)
 	}
+	return stateQueries
 }
 
-func (a *Amplifier) UpdateState(r *Reply) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	switch r.Group {
-	case "02":
-		switch r.Number {
-		case "01":
-			a.state.Power = r.Data == "1"
-
-			// Powering off resets the muted and source state.
-			if !a.state.Power {
-				a.state.Mute = false
-				a.state.Source = ""
-			}
-		case "03":
-			a.state.Mute = r.Data == "1"
+// QueryState sends the queries for the amplifier state, one at a time so
+// that their replies can't be taken for a command's. The queries only
+// available when on are skipped in standby.
+func (a *Amplifier) QueryState(ctx context.Context) error {
+	for _, c := range a.stateQueries() {
+		if needsPower(c) && !a.State().Power {
+			continue
 		}
-	case "04":
-		if r.Number == "01" {
-			a.state.Source = sources[r.Data]
+		if err := a.roundTrip(ctx, c); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-// ServeHTTP serves the amplifier status.
-func (a *Amplifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// user, pwd, ok := r.BasicAuth()
-	// TODO
+// SelfTest checks the amplifier replies, by querying its protocol version
+// and waiting up to confirmTimeout for the reply.
+func (a *Amplifier) SelfTest(ctx context.Context) error {
+	if a.dryRun {
+		log.Printf("Dry run, skipping the self-test")
+		return nil
+	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	return a.sendAndConfirm(ctx, GetProtocolVersion)
+}
 
-	if r.Method == "POST" {
-		var req struct {
-			Power  string
-			Mute   string
-			Source string
-		}
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+// queryWakeState queries the state reset while the amplifier was in standby,
+// after the command that woke it got its reply.
+func (a *Amplifier) queryWakeState() {
+	for _, c := range []Command{GetSource, GetMuteState} {
+		if err := a.roundTrip(context.Background(), c); err != nil {
+			log.Printf("error, querying state after power on: %v", err)
 			return
 		}
-		log.Printf("Request: %v", req)
-		if err := a.handlePower(req.Power); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		if err := a.handleMute(req.Mute); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		if err := a.handleSource(req.Source); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
 	}
+}
 
-	// GET
-	json.NewEncoder(w).Encode(a.state)
-	log.Printf("Sent state: %v", a.state)
+// needsPower reports whether the command is only available while powered on,
+// so the amplifier rejecting it as not available hints it's in standby.
+func needsPower(c Command) bool {
+	return c.Group == "03" || (c.Group == "01" && c.Number == "04")
 }
 
-// handlePower updates the power status from the given string.
-func (a *Amplifier) handlePower(s string) error {
-	var c Command
+// queryPower queries the power state, to reconcile it after a command was
+// rejected as not available.
+func (a *Amplifier) queryPower() {
+	if err := a.roundTrip(context.Background(), GetPowerState); err != nil {
+		log.Printf("error, querying power state after rejected command: %v", err)
+	}
+}
 
-	switch s {
-	case "on":
+// SendCommand sends a command to the amplifier.
+func (a *Amplifier) SendCommand(cmd Command) error {
+	return a.SendCommandContext(context.Background(), cmd)
+}
+
+// SendCommandContext sends a command to the amplifier, giving up when ctx is
+// done, or after sendTimeout when ctx has no deadline.
+func (a *Amplifier) SendCommandContext(ctx context.Context, cmd Command) error {
+	if err := cmd.Validate(); err != nil {
+		return err
+	}
+
+	s := fmt.Sprintf("#%s,%s", cmd.Group, cmd.Number)
+	if cmd.Data != "" {
+		s += "," + cmd.Data
+	}
+	s += a.terminator
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sendTimeout)
+		defer cancel()
+	}
+
+	a.noteSent(cmd)
+	if a.dryRun {
+		log.Printf("Dry run, not sending: %q", s)
+		a.simulateReply(cmd)
+		return nil
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	if err := a.sleepContext(ctx, a.commandGap-a.clock.Now().Sub(a.lastWrite)); err != nil {
+		return err
+	}
+	a.writeStarted = a.clock.Now()
+	defer func() { a.lastWrite = a.clock.Now() }()
+
+	buf := []byte(s)
+	for attempt := 0; ; attempt++ {
+		n, err := a.write(ctx, buf)
+		if err == nil {
+			a.debugf("command to amp %q", s)
+			a.metrics.observeSent(cmd)
+			return nil
+		}
+		if isPermanent(err) {
+			return &ErrPortClosed{Port: a.portName, Err: err}
+		}
+		if ctx.Err() != nil || attempt >= a.writeRetries {
+			return err
+		}
+		buf = buf[n:]
+		log.Printf("error, write attempt %d: %v, retrying", attempt+1, err)
+		if err := a.sleepContext(ctx, time.Duration(attempt+1)*writeBackoff); err != nil {
+			return err
+		}
+	}
+}
+
+// transientMuteWindow is how long after a source switch a mute the amplifier
+// reports without it being requested is taken as transient.
+const transientMuteWindow = 2 * time.Second
+
+// noteSent records when source switches and mute changes were last sent, see
+// transientMute.
+func (a *Amplifier) noteSent(c Command) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clock.Now()
+	switch {
+	case c.Group == "03" && (c.Number == "02" || c.Number == "03" || c.Number == "04"):
+		a.sourceSwitchedAt = now
+	case c.Group == "01" && c.Number == "04":
+		a.muteRequestedAt = now
+	}
+}
+
+// transientMute reports whether a mute is the one the amplifier briefly
+// applies while switching sources, rather than requested, mu must be held.
+// The mute state is then queried again once the switch is over.
+func (a *Amplifier) transientMute() bool {
+	now := a.clock.Now()
+	if now.Sub(a.sourceSwitchedAt) >= transientMuteWindow || now.Sub(a.muteRequestedAt) < transientMuteWindow {
+		return false
+	}
+
+	if a.muteCheck != nil {
+		a.muteCheck.Stop()
+	}
+	a.muteCheck = a.clock.AfterFunc(transientMuteWindow-now.Sub(a.sourceSwitchedAt), func() {
+		if err := a.roundTrip(context.Background(), GetMuteState); err != nil {
+			log.Printf("error, querying mute state after source switch: %v", err)
+		}
+	})
+	return true
+}
+
+// write writes buf to the port, returning early when ctx is done. As a
+// blocked write can't be interrupted, the next write first waits for an
+// abandoned one to complete so they don't interleave. The abandoned write
+// keeps the port it started on, which reconnect may replace meanwhile.
+// writeMu must be held.
+func (a *Amplifier) write(ctx context.Context, buf []byte) (int, error) {
+	if a.inflight != nil {
+		select {
+		case <-a.inflight:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	done := make(chan struct{})
+	a.inflight = done
+
+	var n int
+	var err error
+	a.portMu.Lock()
+	port := a.port
+	a.portMu.Unlock()
+	go func() {
+		n, err = port.Write(buf)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return n, err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// sleepContext sleeps for d on the amplifier clock or until ctx is done.
+func (a *Amplifier) sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	select {
+	case <-a.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeBackoff is the delay added after each failed write attempt.
+const writeBackoff = 50 * time.Millisecond
+
+// sendTimeout bounds the sends without a deadline of their own, e.g. from the
+// poll, the sleep timer or a debounced source switch, so that one blocked on
+// a stuck port gives up writeMu.
+const sendTimeout = 5 * time.Second
+
+// closePort closes the current port, unblocking a pending read or write.
+func (a *Amplifier) closePort() error {
+	a.portMu.Lock()
+	defer a.portMu.Unlock()
+	return a.port.Close()
+}
+
+// isPermanent reports whether err means the port is unusable and retrying the
+// write is pointless.
+func isPermanent(err error) bool {
+	var pe *serial.PortError
+	if errors.As(err, &pe) {
+		return pe.Code() == serial.PortClosed
+	}
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// replyGroup returns the group of the replies to the given command.
+func replyGroup(c Command) string {
+	g, err := strconv.Atoi(c.Group)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%02d", g+1)
+}
+
+// confirmingReply maps commands, by group and number, to the number of the
+// reply confirming them. Selecting and cycling sources are all confirmed by
+// the current source reply.
+var confirmingReply = map[[2]string]string{
+	{"01", "02"}: "01", // Power
+	{"01", "04"}: "03", // Mute
+	{"01", "25"}: "24", // Speaker output
+	{"01", "29"}: "28", // Display brightness
+	{"01", "31"}: "30", // Auto power down
+	{"01", "33"}: "32", // Startup volume
+	{"01", "35"}: "34", // Max volume
+	{"03", "02"}: "01", // Next source
+	{"03", "03"}: "01", // Previous source
+	{"03", "04"}: "01", // Source
+	{"03", "05"}: "05", // Source trim query
+	{"03", "06"}: "05", // Source trim
+	{"03", "07"}: "07", // Bluetooth pairing
+	{"05", "02"}: "01", // Bass
+	{"05", "04"}: "03", // Treble
+	{"05", "06"}: "05", // Balance
+}
+
+// valueCommands are the commands, by group and number, only confirmed by a
+// reply reporting the value they set. A reply with another value reports the
+// state before the change, e.g. the answer to a poll sent just before.
+var valueCommands = map[[2]string]bool{
+	{"01", "02"}: true, // Power
+	{"01", "04"}: true, // Mute
+	{"01", "25"}: true, // Speaker output
+	{"01", "33"}: true, // Startup volume
+	{"01", "35"}: true, // Max volume
+	{"03", "04"}: true, // Source
+}
+
+// confirms reports whether the reply confirms the command, commands missing
+// from confirmingReply are confirmed by any reply of their group.
+func confirms(r *Reply, c Command) bool {
+	if r.Group != replyGroup(c) {
+		return false
+	}
+	key := [2]string{c.Group, c.Number}
+	if number, ok := confirmingReply[key]; ok && r.Number != number {
+		return false
+	}
+	return !valueCommands[key] || sameValue(r.Data, c.Data)
+}
+
+// sameValue reports whether the reply data is the value of the command data,
+// numbers may be padded differently.
+func sameValue(reply, data string) bool {
+	if reply == data {
+		return true
+	}
+	r, err := strconv.Atoi(reply)
+	if err != nil {
+		return false
+	}
+	d, err := strconv.Atoi(data)
+	return err == nil && r == d
+}
+
+// sendAndConfirm sends the command and waits for the amplifier to confirm it,
+// the state is then updated from the reply. A rejected or unconfirmed command
+// returns an error, the state is then left as last reported.
+func (a *Amplifier) sendAndConfirm(ctx context.Context, c Command) error {
+	a.armSleep()
+	return a.roundTrip(ctx, c)
+}
+
+// roundTrip sends the command and waits for the reply confirming it, holding
+// cmdMu so that the reply isn't taken for another command's. Unlike
+// sendAndConfirm it doesn't restart the sleep timer, for the queries sent
+// without a request.
+func (a *Amplifier) roundTrip(ctx context.Context, c Command) error {
+	a.cmdMu.Lock()
+	defer a.cmdMu.Unlock()
+
+	replies, cancel := a.watchReplies()
+	defer cancel()
+
+	if err := a.SendCommandContext(ctx, c); err != nil {
+		return err
+	}
+	sent := a.clock.Now()
+
+	timeout := a.clock.After(a.confirmTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r := <-replies:
+			switch {
+			case confirms(r, c):
+				a.metrics.observeLatency(c, a.clock.Now().Sub(sent))
+				return nil
+			case r.Group == "00":
+				err := &ErrCommandRejected{Command: c, Reply: *r}
+				if err.NotAvailable() && needsPower(c) {
+					// Likely in standby without the state knowing it.
+					go a.queryPower()
+				}
+				return err
+			}
+		case <-timeout:
+			a.metrics.observeTimeout(c)
+			return &ErrReplyTimeout{Command: c, Timeout: a.confirmTimeout}
+		}
+	}
+}
+
+// isTimeout reports whether err is a read timeout rather than a port error.
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// maxPartialReply bounds the unterminated data kept between reads.
+const maxPartialReply = 1024
+
+// readUpdate reads from the port and updates the state accordingly, a read
+// timeout without data is not an error. Only complete replies are parsed, a
+// trailing partial reply is kept until the next read completes it.
+func (a *Amplifier) readUpdate() error {
+	buf := make([]byte, 1024)
+
+	n, err := a.port.Read(buf)
+	if err != nil && !isTimeout(err) {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	a.debugf("response from amp %q", buf[:n])
+	a.partial = append(a.partial, buf[:n]...)
+	end := bytes.LastIndex(a.partial, []byte(a.terminator))
+	if end < 0 {
+		if len(a.partial) > maxPartialReply {
+			a.parseError("error, invalid reply format, no terminator: %q", a.partial)
+			a.partial = nil
+		}
+		return nil
+	}
+	end += len(a.terminator)
+	response := string(a.partial[:end])
+	a.partial = append(a.partial[:0], a.partial[end:]...)
+
+	// Malformed frames are parse errors, while well formed replies this
+	// code doesn't model are passed on without updating the state.
+	received := false
+	for _, frame := range strings.SplitAfter(response, a.terminator) {
+		if frame == "" {
+			continue
+		}
+		reply, err := parseReply(strings.TrimSuffix(frame, a.terminator))
+		if err != nil {
+			a.parseError("error, %v", err)
+			continue
+		}
+		received = true
+
+		a.history.add(reply)
+		if reply.modeled() {
+			log.Printf("Received: %v", reply)
+			a.UpdateState(reply)
+		} else {
+			a.debugf("unhandled reply group %s number %s, data %q", reply.Group, reply.Number, reply.Data)
+		}
+		a.notifyWatchers(reply)
+	}
+	if received {
+		a.lastReplyTime.Store(a.clock.Now().UnixNano())
+	}
+	return nil
+}
+
+// parseReply parses a reply frame without its terminator.
+func parseReply(frame string) (*Reply, error) {
+	m := validReply.FindStringSubmatch(trimPadding(frame))
+	if m == nil {
+		return nil, &ErrInvalidReply{Reason: "reply format", Data: frame}
+	}
+
+	reply := &Reply{
+		Group:  m[1],
+		Number: m[2],
+	}
+	// If data is present, capture it
+	if len(m) > 3 {
+		reply.Data = m[3]
+	}
+	return reply, nil
+}
+
+// trimPadding removes the whitespace and null bytes some serial adapters pad
+// the replies with, the reply data never starts or ends with them.
+func trimPadding(frame string) string {
+	return strings.TrimFunc(frame, func(r rune) bool {
+		return r == 0 || unicode.IsSpace(r)
+	})
+}
+
+// debugf logs the message at the debug level.
+func (a *Amplifier) debugf(format string, v ...any) {
+	if a.debug {
+		log.Printf("Debug: "+format, v...)
+	}
+}
+
+// parseError counts and logs a reply which couldn't be parsed, a noisy line
+// only logs once per parseErrorInterval.
+func (a *Amplifier) parseError(format string, v ...any) {
+	a.metrics.parseErrors.Add(1)
+	a.parseLog.Printf(format, v...)
+}
+
+// parseErrorInterval is the minimum interval between parse error logs.
+const parseErrorInterval = 10 * time.Second
+
+// watchReplies returns a channel receiving every reply read from the amplifier
+// until the returned cancel function is called.
+func (a *Amplifier) watchReplies() (<-chan *Reply, func()) {
+	ch := make(chan *Reply, 16)
+
+	a.watchersMu.Lock()
+	if a.watchers == nil {
+		a.watchers = make(map[chan *Reply]struct{})
+	}
+	a.watchers[ch] = struct{}{}
+	a.watchersMu.Unlock()
+
+	return ch, func() {
+		a.watchersMu.Lock()
+		delete(a.watchers, ch)
+		a.watchersMu.Unlock()
+	}
+}
+
+// notifyWatchers passes the reply to the watchers, dropping it for those which
+// are not keeping up.
+func (a *Amplifier) notifyWatchers(r *Reply) {
+	a.watchersMu.Lock()
+	defer a.watchersMu.Unlock()
+
+	for ch := range a.watchers {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
+
+// Listen calls readUpdate until ctx is done, reconnecting on read errors.
+func (a *Amplifier) Listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := a.readUpdate(); err != nil {
+			if ctx.Err() != nil {
+				// The port was closed on shutdown.
+				return
+			}
+			log.Printf("error, readUpdate(): %v", err)
+			a.reconnect(ctx, err)
+		}
+	}
+}
+
+// Start listens to the replies, and polls the state if enabled, until ctx is
+// done or the amplifier is closed.
+func (a *Amplifier) Start(ctx context.Context) {
+	ctx, a.cancel = context.WithCancel(ctx)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.Listen(ctx)
+	}()
+	if a.pollInterval > 0 {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.Poll(ctx)
+		}()
+	}
+	// The port can only be reopened by name.
+	if a.watchdog > 0 && a.portName != "" {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.Watchdog(ctx)
+		}()
+	}
+}
+
+// Close stops the goroutines started by Start and closes the port, it's safe
+// to call more than once. A pending debounced source change is dropped, see
+// flushSource.
+func (a *Amplifier) Close() error {
+	a.closeOnce.Do(func() {
+		if a.cancel != nil {
+			a.cancel()
+		}
+		a.stopSleep()
+		a.dropSource(&ErrPortClosed{Port: a.portName, Err: os.ErrClosed})
+		a.mu.Lock()
+		if a.muteCheck != nil {
+			a.muteCheck.Stop()
+		}
+		a.mu.Unlock()
+
+		// Closing the port unblocks a pending read, it's closed again
+		// if a reconnection replaced it in the meantime.
+		a.portMu.Lock()
+		port := a.port
+		a.closeErr = port.Close()
+		a.portMu.Unlock()
+
+		a.wg.Wait()
+
+		a.portMu.Lock()
+		if a.port != port {
+			a.port.Close()
+		}
+		a.portMu.Unlock()
+	})
+
+	return a.closeErr
+}
+
+// UpdateState applies the reply to the state with its handler in
+// replyHandlers, replies without one are ignored.
+func (a *Amplifier) UpdateState(r *Reply) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	prev := a.state
+	defer a.notifyChanged()
+	defer a.publishChanges(prev)
+	defer func() {
+		now := a.clock.Now().UTC().Truncate(time.Second)
+		if a.state.Power != prev.Power {
+			a.state.PowerChangedAt = &now
+		}
+		if a.state.Mute != prev.Mute {
+			a.state.MuteChangedAt = &now
+		}
+		if a.state.Source != prev.Source {
+			a.state.SourceChangedAt = &now
+		}
+	}()
+
+	if h, ok := replyHandlers[[2]string{r.Group, r.Number}]; ok && h.update != nil {
+		h.update(a, r, prev)
+	}
+}
+
+// protectionEngaged reports whether the protection status shuts the outputs
+// down.
+func protectionEngaged(protection string) bool {
+	return protection != "" && protection != protectionStates["0"]
+}
+
+// setKnown records whether the state field was confirmed by the amplifier, mu
+// must be held.
+func (a *Amplifier) setKnown(field string, known bool) {
+	if a.known == nil {
+		a.known = make(map[string]bool)
+	}
+	a.known[field] = known
+}
+
+// unchanged reports whether the amplifier already confirmed the state field
+// matches the requested value, in which case the command can be skipped.
+func (a *Amplifier) unchanged(field string, matches func(AmplifierState) bool) bool {
+	if a.alwaysSend {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.known[field] && matches(a.state)
+}
+
+// ServeHTTP serves the amplifier status.
+func (a *Amplifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var fields []string
+	if f := r.URL.Query().Get("fields"); f != "" {
+		fields = strings.Split(f, ",")
+		var unknown []string
+		for _, field := range fields {
+			if !slices.Contains(statusFields, field) {
+				unknown = append(unknown, field)
+			}
+		}
+		if len(unknown) > 0 {
+			writeError(w, fmt.Sprintf("Unknown fields: %s, expected: %s", strings.Join(unknown, ","), strings.Join(statusFields, ",")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.Method == "POST" {
+		var req setRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Request: %v", &req)
+		if err := req.Validate(a); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := a.apply(r.Context(), &req)
+
+		if err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	// GET
+	if r.Method != "POST" && !a.waitForChange(w, r) {
+		return
+	}
+	if fields != nil {
+		a.writeFields(w, fields)
+		return
+	}
+	a.writeState(w)
+}
+
+// apply applies the changes of the request, returning the errors of all the
+// fields.
+func (a *Amplifier) apply(ctx context.Context, req *setRequest) error {
+	var errs []error
+	for _, f := range []struct {
+		value  *string
+		handle func(context.Context, string) error
+	}{{req.Power, a.handlePower}, {req.Mute, a.handleMute}, {req.Source, a.handleSource}} {
+		if f.value != nil {
+			errs = append(errs, f.handle(ctx, *f.value))
+		}
+	}
+	errs = append(errs,
+		a.handleTone(ctx, "bass", req.Bass, SetBass),
+		a.handleTone(ctx, "treble", req.Treble, SetTreble),
+		a.handleTone(ctx, "balance", req.Balance, SetBalance),
+	)
+	if req.SpeakerOutput != nil {
+		errs = append(errs, a.handleSpeakers(ctx, *req.SpeakerOutput))
+	}
+	return errors.Join(errs...)
+}
+
+// setRequest is the body of a POST request, nil fields are left unchanged.
+type setRequest struct {
+	Power   *string
+	Mute    *string
+	Source  *string
+	Bass    *int
+	Treble  *int
+	Balance *int
+
+	SpeakerOutput *string
+}
+
+// String returns the fields set in the request, for logging.
+func (req *setRequest) String() string {
+	var fields []string
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"power", req.Power}, {"mute", req.Mute}, {"source", req.Source}, {"speakerOutput", req.SpeakerOutput}} {
+		if f.value != nil {
+			fields = append(fields, fmt.Sprintf("%s=%q", f.name, *f.value))
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		level *int
+	}{{"bass", req.Bass}, {"treble", req.Treble}, {"balance", req.Balance}} {
+		if f.level != nil {
+			fields = append(fields, fmt.Sprintf("%s=%d", f.name, *f.level))
+		}
+	}
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// Accepted values for the setRequest fields.
+var (
+	powerValues   = []string{"on", "off", "toggle"}
+	muteValues    = []string{"on", "off", "muted", "unmuted", "toggle"}
+	speakerValues = []string{"A", "B", "AB", "A+B"}
+)
+
+// Validate checks all the fields of the request against their accepted
+// values on the amplifier, returning every problem found.
+func (req *setRequest) Validate(a *Amplifier) error {
+	var errs []error
+
+	// Omitted fields are left unchanged, an empty value is an error.
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"Power", req.Power}, {"Mute", req.Mute}, {"Source", req.Source}, {"SpeakerOutput", req.SpeakerOutput}} {
+		if f.value != nil && *f.value == "" {
+			errs = append(errs, fmt.Errorf("Empty %s, omit it to leave it unchanged", f.name))
+		}
+	}
+
+	if req.Power != nil && *req.Power != "" && !slices.Contains(powerValues, *req.Power) {
+		errs = append(errs, fmt.Errorf("Unexpected power state %s, expected: %s", *req.Power, strings.Join(powerValues, "/")))
+	}
+	if req.Mute != nil && *req.Mute != "" && !slices.Contains(muteValues, *req.Mute) {
+		errs = append(errs, fmt.Errorf("Unexpected mute state %s, expected: %s", *req.Mute, strings.Join(muteValues, "/")))
+	}
+	if req.Source != nil && *req.Source != "" {
+		if src, ok := a.findSource(*req.Source); !ok {
+			errs = append(errs, fmt.Errorf("Unknown source: %s", *req.Source))
+		} else if !src.availableOn(a.model) {
+			errs = append(errs, fmt.Errorf("Source %s isn't available on the %s", src.Name, a.model))
+		}
+	}
+	for _, tone := range []struct {
+		level *int
+		set   func(int) (Command, error)
+	}{{req.Bass, SetBass}, {req.Treble, SetTreble}, {req.Balance, SetBalance}} {
+		if tone.level == nil {
+			continue
+		}
+		if _, err := tone.set(*tone.level); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if req.SpeakerOutput != nil && *req.SpeakerOutput != "" && !slices.Contains(speakerValues, strings.ToUpper(*req.SpeakerOutput)) {
+		errs = append(errs, fmt.Errorf("Unexpected speaker output %s, expected: A/B/AB", *req.SpeakerOutput))
+	}
+
+	return errors.Join(errs...)
+}
+
+// statusResponse is the /status reply.
+type statusResponse struct {
+	AmplifierState
+	DisplayName string `json:"displayName,omitempty"`
+	Connection  string `json:"connection"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// statusFields are the statusResponse JSON field names.
+var statusFields []string
+
+func init() {
+	for _, f := range reflect.VisibleFields(reflect.TypeFor[statusResponse]()) {
+		if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+			statusFields = append(statusFields, name)
+		}
+	}
+}
+
+// State returns a copy of the amplifier state, safe to use while replies
+// update it.
+func (a *Amplifier) State() AmplifierState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.copyState()
+}
+
+// copyState returns a copy of the state not sharing its maps and pointers, mu
+// must be held.
+func (a *Amplifier) copyState() AmplifierState {
+	state := a.state
+	state.Trims = maps.Clone(a.state.Trims)
+	for _, p := range []**int{&state.DisplayBrightness, &state.StartupVolume, &state.MaxVolume, &state.Temperature} {
+		if *p != nil {
+			level := **p
+			*p = &level
+		}
+	}
+	return state
+}
+
+// status returns the current state with the connection status.
+func (a *Amplifier) status() statusResponse {
+	state := a.State()
+	status, lastErr := a.connection()
+
+	return statusResponse{state, a.displayName(state.Source), status, lastErr}
+}
+
+// writeState replies with the current state.
+func (a *Amplifier) writeState(w http.ResponseWriter) {
+	resp := a.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", statusETag(resp))
+	json.NewEncoder(w).Encode(resp)
+	log.Printf("Sent state: %v", resp.AmplifierState)
+}
+
+// writeFields replies with the given fields of the current state, fields
+// without a value are null.
+func (a *Amplifier) writeFields(w http.ResponseWriter, fields []string) {
+	st := a.status()
+	buf, err := json.Marshal(st)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &all); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if v, ok := all[field]; ok {
+			resp[field] = v
+		} else {
+			resp[field] = json.RawMessage("null")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", statusETag(st))
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveAction returns a handler running the given action and replying with
+// the resulting state.
+func (a *Amplifier) serveAction(action func(context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := action(r.Context()); err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		a.writeState(w)
+	}
+}
+
+// rawReplyTimeout is how long the raw command endpoint waits for a reply.
+const rawReplyTimeout = 500 * time.Millisecond
+
+// serveCommand sends a raw command to the amplifier and serves its reply.
+func (a *Amplifier) serveCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Group  string `json:"group"`
+		Number string `json:"number"`
+		Data   string `json:"data"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := Command{Group: req.Group, Number: req.Number, Data: req.Data}
+	if err := c.Validate(); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.rules.permit("raw", ""); err != nil {
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Printf("Raw command: %v", c)
+
+	// The first reply is taken as the one to the command.
+	a.cmdMu.Lock()
+	defer a.cmdMu.Unlock()
+	replies, cancel := a.watchReplies()
+	defer cancel()
+
+	a.armSleep()
+	if err := a.SendCommandContext(r.Context(), c); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case reply := <-replies:
+		var resp struct {
+			*Reply
+			Description string `json:"description"`
+		}
+		resp.Reply = reply
+		resp.Description = reply.String()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case <-a.clock.After(rawReplyTimeout):
+		writeError(w, "No reply from amplifier", http.StatusGatewayTimeout)
+	}
+}
+
+// serveSources serves the sources available on the amplifier model.
+func (a *Amplifier) serveSources(w http.ResponseWriter, r *http.Request) {
+	current := a.State().Source
+
+	type source struct {
+		Code        string `json:"code"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+		Selected    bool   `json:"selected"`
+	}
+	list := []source{}
+	for _, src := range sourceTable {
+		if src.availableOn(a.model) {
+			list = append(list, source{Code: src.Code, Name: src.Name, DisplayName: a.displayName(src.Name), Selected: src.Name == current})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveVersion serves the program and amplifier versions.
+func (a *Amplifier) serveVersion(w http.ResponseWriter, r *http.Request) {
+	state := a.State()
+	protocol, firmware := state.ProtocolVersion, state.FirmwareVersion
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version         string `json:"version"`
+		GoVersion       string `json:"goVersion"`
+		ProtocolVersion string `json:"protocolVersion"`
+		FirmwareVersion string `json:"firmwareVersion"`
+	}{version, runtime.Version(), protocol, firmware})
+}
+
+// serveHealth serves the serial connection health.
+func (a *Amplifier) serveHealth(w http.ResponseWriter, r *http.Request) {
+	var health struct {
+		Serial    string `json:"serial"`
+		LastReply string `json:"lastReply,omitempty"`
+	}
+	status := http.StatusOK
+
+	var last time.Time
+	if ns := a.lastReplyTime.Load(); ns != 0 {
+		last = time.Unix(0, ns)
+		health.LastReply = last.Format(time.RFC3339)
+	}
+
+	conn, _ := a.connection()
+	switch {
+	case conn != connConnected:
+		health.Serial = "disconnected"
+		status = http.StatusServiceUnavailable
+	case a.healthStale > 0 && a.clock.Now().Sub(last) > a.healthStale:
+		health.Serial = "stale"
+		status = http.StatusServiceUnavailable
+	default:
+		health.Serial = "connected"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
+
+// handlePower updates the power status from the given string.
+func (a *Amplifier) handlePower(ctx context.Context, s string) error {
+	var c Command
+
+	switch s {
+	case "on":
 		c = SetPowerOn
-		a.state.Power = true
 	case "off":
 		c = SetPowerStandby
-		a.state.Power = false
 	case "toggle":
-		if a.state.Power {
+		if a.State().Power {
 			c = SetPowerStandby
-			a.state.Power = false
 		} else {
 			c = SetPowerOn
-			a.state.Power = true
 		}
 	case "":
 		return nil
 	default:
 		return fmt.Errorf("Unexpected power state %s, expected: on/off/toggle", s)
 	}
+	on := c == SetPowerOn
+	if err := a.rules.permit("power", powerValue(on)); err != nil {
+		return err
+	}
+	if a.unchanged("power", func(st AmplifierState) bool { return st.Power == on }) {
+		return nil
+	}
+
+	return a.sendAndConfirm(ctx, c)
+}
+
+// powerValue returns the power rule value.
+func powerValue(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// errStandby is returned for changes which require the amplifier to be on.
+var errStandby = errors.New("Amplifier is in standby")
+
+// errWrongSource is returned for changes which require another source.
+var errWrongSource = errors.New("Wrong source selected")
+
+// writeError replies to the request with the error message as JSON.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// errorStatus returns the HTTP status code for a handler error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errStandby), errors.Is(err, errWrongSource):
+		return http.StatusConflict
+	}
+
+	var rejected *ErrCommandRejected
+	var timeout *ErrReplyTimeout
+	var closed *ErrPortClosed
+	var invalid *ErrInvalidReply
+	switch {
+	case errors.As(err, &rejected):
+		if rejected.NotAvailable() {
+			return http.StatusConflict
+		}
+		return http.StatusBadGateway
+	case errors.As(err, &timeout):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &closed):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &invalid):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// requirePower returns errStandby if the amplifier is off, unless
+// wakeOnChange is set in which case it's powered on first.
+func (a *Amplifier) requirePower(ctx context.Context) error {
+	if a.State().Power {
+		return nil
+	}
+	if !a.wakeOnChange {
+		return errStandby
+	}
+
+	return a.wake(ctx)
+}
+
+// wake powers the amplifier on if it's off, waiting for the confirmation.
+func (a *Amplifier) wake(ctx context.Context) error {
+	if a.State().Power {
+		return nil
+	}
+	if err := a.rules.permit("power", "on"); err != nil {
+		return fmt.Errorf("%w, waking up: %w", errStandby, err)
+	}
+
+	if err := a.sendAndConfirm(ctx, SetPowerOn); err != nil {
+		return err
+	}
+
+	if !a.State().Power {
+		return fmt.Errorf("%w, power on wasn't confirmed", errStandby)
+	}
+
+	return nil
+}
+
+// serveMute mutes the amplifier, or sets the mute state of the optional JSON
+// body, e.g. {"mute": "off"}. With ?wake=true it's powered on first if needed,
+// otherwise a mute in standby is rejected unless -standby is wake.
+func (a *Amplifier) serveMute(w http.ResponseWriter, r *http.Request) {
+	var wake bool
+	if s := r.URL.Query().Get("wake"); s != "" {
+		var err error
+		if wake, err = strconv.ParseBool(s); err != nil {
+			writeError(w, fmt.Sprintf("Invalid wake %q, expected true or false", s), http.StatusBadRequest)
+			return
+		}
+	}
+	req := struct {
+		Mute string `json:"mute"`
+	}{Mute: "on"}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(muteValues, req.Mute) {
+		writeError(w, fmt.Sprintf("Unexpected mute state %s, expected: %s", req.Mute, strings.Join(muteValues, "/")), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if wake {
+		err = a.wake(r.Context())
+	}
+	if err == nil {
+		err = a.handleMute(r.Context(), req.Mute)
+	}
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
 
-	return a.SendCommand(c)
+	a.writeState(w)
 }
 
 // handleMute updates the mute status from the given string.
-func (a *Amplifier) handleMute(s string) error {
-	if !a.state.Power {
+func (a *Amplifier) handleMute(ctx context.Context, s string) error {
+	if s == "" {
 		return nil
 	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
+	mute := a.State().Mute
 	var c Command
 
 	switch s {
 	case "on", "muted":
 		c = SetMuteOn
-		a.state.Mute = true
 	case "off", "unmuted":
 		c = SetMuteOff
-		a.state.Mute = false
-	case "":
-		return nil
+	case "toggle":
+		if mute {
+			c = SetMuteOff
+		} else {
+			c = SetMuteOn
+		}
 	default:
-		return fmt.Errorf("Unexpected mute state %s, expected: on/off/muted/unmuted", s)
+		return fmt.Errorf("Unexpected mute state %s, expected: on/off/muted/unmuted/toggle", s)
+	}
+	muted := c == SetMuteOn
+	if err := a.rules.permit("mute", powerValue(muted)); err != nil {
+		return err
+	}
+	if a.unchanged("mute", func(st AmplifierState) bool { return st.Mute == muted }) {
+		return nil
 	}
 
-	return a.SendCommand(c)
+	return a.sendAndConfirm(ctx, c)
 }
 
 // handleSource updates the source from the given string.
-func (a *Amplifier) handleSource(s string) error {
-	if !a.state.Power {
+func (a *Amplifier) handleSource(ctx context.Context, s string) error {
+	if s == "" {
+		return nil
+	}
+
+	src, ok := a.findSource(s)
+	if !ok {
+		return fmt.Errorf("Unknown source: %s", s)
+	}
+	if !src.availableOn(a.model) {
+		return fmt.Errorf("Source %s isn't available on the %s", src.Name, a.model)
+	}
+	if err := a.rules.permit("source", src.Name); err != nil {
+		return err
+	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
+	if a.unchanged("source", func(st AmplifierState) bool { return st.Source == src.Name }) {
+		// Drop any debounced change, the amplifier is already on the
+		// latest requested source.
+		a.dropSource(nil)
+		return nil
+	}
+
+	return a.sendSource(ctx, src.Command)
+}
+
+// serveSourceA1 selects the A1 input, balanced with ?balanced=true where the
+// model has it, and replies with the state once the source is switched.
+func (a *Amplifier) serveSourceA1(w http.ResponseWriter, r *http.Request) {
+	var balanced bool
+	if s := r.URL.Query().Get("balanced"); s != "" {
+		var err error
+		if balanced, err = strconv.ParseBool(s); err != nil {
+			writeError(w, fmt.Sprintf("Invalid balanced %q, expected true or false", s), http.StatusBadRequest)
+			return
+		}
+	}
+	src := sourcesByName["a1"]
+	if balanced {
+		src = sourcesByName["a1 balanced"]
+	}
+	if !src.availableOn(a.model) {
+		writeError(w, fmt.Sprintf("Source %s isn't available on the %s", src.Name, a.model), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.handleSource(r.Context(), src.Name); err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	a.writeState(w)
+}
+
+// sourceFlush is a debounced source change, done is closed once the last
+// source requested within the window is confirmed, or failed with err.
+type sourceFlush struct {
+	cmd  Command
+	done chan struct{}
+	err  error
+}
+
+// sendSource sends the source command once no other source change has been
+// requested within the debounce window, and waits for its confirmation. The
+// requests collapsed into one get the result of the last one.
+func (a *Amplifier) sendSource(ctx context.Context, c Command) error {
+	if a.sourceDebounce <= 0 {
+		return a.confirmSource(ctx, c)
+	}
+
+	a.sourceMu.Lock()
+	if a.pendingSource == nil {
+		a.pendingSource = &sourceFlush{done: make(chan struct{})}
+	}
+	pending := a.pendingSource
+	pending.cmd = c
+	if a.sourceTimer != nil {
+		a.sourceTimer.Stop()
+	}
+	a.sourceTimer = a.clock.AfterFunc(a.sourceDebounce, func() {
+		if err := a.flushSource(); err != nil {
+			log.Printf("error, sending source: %v", err)
+		}
+	})
+	a.sourceMu.Unlock()
+
+	select {
+	case <-pending.done:
+		return pending.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushSource sends the pending source command if any, without waiting for
+// the end of the debounce window.
+func (a *Amplifier) flushSource() error {
+	a.sourceMu.Lock()
+	if a.sourceTimer != nil {
+		a.sourceTimer.Stop()
+		a.sourceTimer = nil
+	}
+	pending := a.pendingSource
+	a.pendingSource = nil
+	a.sourceMu.Unlock()
+	if pending == nil {
 		return nil
 	}
+
+	a.armSleep()
+	// Not bound to a request, the change is shared by the collapsed ones.
+	pending.err = a.confirmSource(context.Background(), pending.cmd)
+	close(pending.done)
+	return pending.err
+}
+
+// dropSource cancels the pending source command if any, the requests waiting
+// for it get err.
+func (a *Amplifier) dropSource(err error) {
+	a.sourceMu.Lock()
+	defer a.sourceMu.Unlock()
+
+	if a.sourceTimer != nil {
+		a.sourceTimer.Stop()
+		a.sourceTimer = nil
+	}
+	if a.pendingSource != nil {
+		a.pendingSource.err = err
+		close(a.pendingSource.done)
+		a.pendingSource = nil
+	}
+}
+
+// confirmSource sends the source command and waits for its confirmation.
+// With verifySource the source is then queried, and the command sent once
+// more if the amplifier isn't on the requested source.
+func (a *Amplifier) confirmSource(ctx context.Context, c Command) error {
+	if !a.verifySource {
+		return a.sendAndConfirm(ctx, c)
+	}
+
+	var want string
+	for _, src := range sourceTable {
+		if src.Command == c {
+			want = src.Name
+		}
+	}
+
+	var got string
+	for attempt := 1; attempt <= 2; attempt++ {
+		// Landing on another source, the amplifier doesn't confirm the
+		// command: the query tells where it is.
+		var timeout *ErrReplyTimeout
+		if err := a.sendAndConfirm(ctx, c); err != nil && !errors.As(err, &timeout) {
+			return err
+		}
+		if err := a.sendAndConfirm(ctx, GetSource); err != nil {
+			return err
+		}
+
+		got = a.State().Source
+		if got == want {
+			return nil
+		}
+		log.Printf("error, requested source %s but the amplifier is on %s (attempt %d/2)", want, got, attempt)
+	}
+
+	return fmt.Errorf("Source mismatch, requested %s but the amplifier is on %s", want, got)
+}
+
+// handleSpeakers updates the speaker output from the given string.
+func (a *Amplifier) handleSpeakers(ctx context.Context, s string) error {
 	var c Command
 
-	switch s {
-	case "A1":
-		c = SetSourceA1
-		a.state.Source = "A1"
-	case "A2":
-		c = SetSourceA2
-		a.state.Source = "A2"
-	case "A3":
-		c = SetSourceA3
-		a.state.Source = "A3"
-	case "A4":
-		c = SetSourceA4
-		a.state.Source = "A4"
-	case "D1":
-		c = SetSourceD1
-		a.state.Source = "D1"
-	case "D2":
-		c = SetSourceD2
-		a.state.Source = "D2"
-	case "D3":
-		c = SetSourceD3
-		a.state.Source = "D3"
-	case "MP3":
-		c = SetSourceMP3
-		a.state.Source = "MP3"
-	case "Bluetooth":
-		c = SetSourceBluetooth
-		a.state.Source = "Bluetooth"
-	case "USB":
-		c = SetSourceUSBAudio
-		a.state.Source = "USB"
-	case "A1 Balanced":
-		c = SetSourceA1Balanced
-		a.state.Source = "A1 Balanced"
+	switch strings.ToUpper(s) {
+	case "A":
+		c = SetSpeakerA
+	case "B":
+		c = SetSpeakerB
+	case "AB", "A+B":
+		c = SetSpeakerAB
 	case "":
 		return nil
 	default:
-		return fmt.Errorf("Unknown source: %s", s)
+		return fmt.Errorf("Unexpected speaker output %s, expected: A/B/AB", s)
+	}
+	output := speakerOutputs[c.Data]
+	if err := a.rules.permit("speakers", output); err != nil {
+		return err
+	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
+	if a.unchanged("speakerOutput", func(st AmplifierState) bool { return st.SpeakerOutput == output }) {
+		return nil
 	}
 
-	return a.SendCommand(c)
+	return a.sendAndConfirm(ctx, c)
 }
 
-func main() {
-	var wg sync.WaitGroup
+// cycleSource selects the next or previous source with the given command.
+func (a *Amplifier) cycleSource(ctx context.Context, c Command) error {
+	if err := a.rules.permit("source", ""); err != nil {
+		return err
+	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
 
-	flag.Parse()
-	mux := http.NewServeMux()
+	return a.sendAndConfirm(ctx, c)
+}
+
+// pairBluetooth makes the Bluetooth input discoverable, it must be the
+// current source.
+func (a *Amplifier) pairBluetooth(ctx context.Context) error {
+	if err := a.rules.permit("bluetooth", ""); err != nil {
+		return err
+	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
+
+	source := a.State().Source
+	if source != "Bluetooth" {
+		return fmt.Errorf("%w, pairing requires Bluetooth but the source is %s", errWrongSource, source)
+	}
+
+	return a.sendAndConfirm(ctx, SetBluetoothPairing)
+}
 
-	amp, err := NewAmplifier(*port)
+// handleTone updates a tone level using the given command constructor.
+func (a *Amplifier) handleTone(ctx context.Context, field string, level *int, set func(int) (Command, error)) error {
+	if level == nil {
+		return nil
+	}
+
+	c, err := set(*level)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := a.rules.permit(field, ""); err != nil {
+		return err
+	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
+	if a.unchanged(field, func(st AmplifierState) bool { return toneLevels[field](st) == *level }) {
+		return nil
+	}
+
+	return a.sendAndConfirm(ctx, c)
+}
+
+// toneLevels returns the tone levels from the state by field name.
+var toneLevels = map[string]func(AmplifierState) int{
+	"bass":    func(st AmplifierState) int { return st.Bass },
+	"treble":  func(st AmplifierState) int { return st.Treble },
+	"balance": func(st AmplifierState) int { return st.Balance },
+}
+
+// validateListenAddr checks addr is a valid host:port, or unix:/path, listen
+// address.
+func validateListenAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if path == "" {
+			return fmt.Errorf("Invalid listen address %q: missing socket path", addr)
+		}
+		return nil
 	}
-	defer amp.port.Close()
 
-	// Get initial state.
-	err = amp.SendCommand(GetPowerState)
+	_, p, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Invalid listen address %q: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("Invalid listen address %q: bad port %q", addr, p)
+	}
+
+	return nil
+}
+
+// routes returns the HTTP handler for the amplifier endpoints.
+func (a *Amplifier) routes(enableRaw, enableUI bool) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle("/status", a)
+	mux.HandleFunc("/healthz", a.serveHealth)
+	mux.HandleFunc("GET /power", a.serveField("power", func(st AmplifierState) any { return st.Power }))
+	mux.HandleFunc("GET /mute", a.serveField("mute", func(st AmplifierState) any { return st.Mute }))
+	mux.HandleFunc("GET /source", a.serveField("source", func(st AmplifierState) any { return st.Source }))
+	mux.HandleFunc("GET /api/sources", a.serveSources)
+	mux.HandleFunc("GET /version", a.serveVersion)
+	mux.HandleFunc("POST /sleep", a.serveSleep)
+	mux.HandleFunc("GET /log", a.serveLog)
+	mux.HandleFunc("POST /refresh", a.serveRefresh)
+	mux.HandleFunc("GET /metrics", a.serveMetrics)
+	mux.HandleFunc("GET /diagnostics", a.serveDiagnostics)
+	mux.HandleFunc("POST /admin/reconnect", a.serveReconnect)
+	mux.HandleFunc("GET /openapi.json", serveOpenAPI)
+	mux.HandleFunc("POST /macro/{name}", a.serveMacro)
+	mux.HandleFunc("POST /batch", a.serveBatch)
+	mux.HandleFunc("GET /events", a.serveEvents)
+	mux.HandleFunc("GET /source/{name}/trim", a.serveTrim)
+	mux.HandleFunc("PUT /source/{name}/trim", a.serveTrim)
+	mux.HandleFunc("PUT /settings/auto-power-down", a.serveAutoPowerDown)
+	mux.Handle("GET /settings/startup-volume", a.levelHandler(startupVolumeSetting))
+	mux.Handle("PUT /settings/startup-volume", a.levelHandler(startupVolumeSetting))
+	mux.Handle("GET /settings/max-volume", a.levelHandler(maxVolumeSetting))
+	mux.Handle("PUT /settings/max-volume", a.levelHandler(maxVolumeSetting))
+	mux.Handle("GET /display/brightness", a.levelHandler(brightnessSetting))
+	mux.Handle("PUT /display/brightness", a.levelHandler(brightnessSetting))
+	mux.Handle("POST /power/toggle", a.serveAction(func(ctx context.Context) error { return a.handlePower(ctx, "toggle") }))
+	mux.HandleFunc("POST /mute", a.serveMute)
+	mux.Handle("POST /mute/toggle", a.serveAction(func(ctx context.Context) error { return a.handleMute(ctx, "toggle") }))
+	mux.HandleFunc("POST /source/a1", a.serveSourceA1)
+	mux.Handle("POST /source/next", a.serveAction(func(ctx context.Context) error { return a.cycleSource(ctx, GetNextSource) }))
+	mux.Handle("POST /source/bluetooth/pair", a.serveAction(a.pairBluetooth))
+	mux.Handle("POST /source/prev", a.serveAction(func(ctx context.Context) error { return a.cycleSource(ctx, GetPreviousSource) }))
+	if enableRaw {
+		mux.HandleFunc("/command", a.serveCommand)
 	}
-	err = amp.SendCommand(GetMuteState)
+	if enableUI {
+		mux.HandleFunc("GET /{$}", serveUI)
+	}
+
+	return mux
+}
+
+// startAmplifier opens the amplifier, queries its initial state, which ctx
+// bounds, and listens to its replies until run is done or it's closed.
+func startAmplifier(ctx, run context.Context, cfg *Config) (*Amplifier, error) {
+	amp, err := NewAmplifier(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	amp.Start(run)
+
+	if cfg.SelfTest || cfg.SelfTestFatal {
+		if err := amp.SelfTest(ctx); err != nil {
+			if cfg.SelfTestFatal {
+				amp.Close()
+				return nil, fmt.Errorf("Self-test failed: %w", err)
+			}
+			log.Printf("warning, self-test failed: %v", err)
+		} else {
+			log.Printf("Self-test passed, the amplifier replies")
+		}
+	}
+
+	// Get initial state, best effort as the amplifier may not reply in
+	// standby: the state is filled in as late replies arrive.
+	st, err := amp.QueryAll(ctx)
+	if err != nil {
+		log.Printf("warning, querying initial state: %v", err)
+	}
+
+	// The reported model selects the sources, the configured one is only
+	// used when the amplifier doesn't report it.
+	if model, ok := detectModel(st.Model); ok {
+		if model != amp.model {
+			log.Printf("Detected the %s, overriding the configured %s", model, amp.model)
+		}
+		amp.model = model
+	} else if st.Model != "" {
+		log.Printf("warning, unknown model %q reported, keeping the configured %s", st.Model, amp.model)
 	}
-	err = amp.SendCommand(GetSource)
+
+	return amp, nil
+}
+
+func main() {
+	flag.Parse()
+	mux := http.NewServeMux()
+
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	wg.Add(1)
-	go amp.Listen()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var audit *auditLog
+	if cfg.AuditLog != "" {
+		if audit, err = openAuditLog(cfg.AuditLog, cfg.AuditLogMaxSize); err != nil {
+			log.Fatal(err)
+		}
+		defer audit.Close()
+	}
+
+	// The amplifiers outlive the signal as their state is saved on shutdown.
+	run, stopAmps := context.WithCancel(context.Background())
+	defer stopAmps()
 
-	mux.Handle("/status", amp)
+	var amps []*Amplifier
+	for _, ac := range cfg.amplifiers() {
+		amp, err := startAmplifier(ctx, run, cfg.forAmplifier(ac))
+		if err != nil {
+			if ac.Name != "" {
+				log.Fatalf("Amplifier %s: %v", ac.Name, err)
+			}
+			log.Fatal(err)
+		}
+		defer amp.Close()
+		amps = append(amps, amp)
+		if audit != nil {
+			go amp.auditStateChanges(run, audit, ac.Name)
+		}
+
+		if ac.Name != "" {
+			prefix := "/amp/" + ac.Name
+			mux.Handle(prefix+"/", http.StripPrefix(prefix, amp.routes(cfg.EnableRaw, cfg.EnableUI)))
+		}
+	}
+
+	// A single amplifier is also served at the root.
+	if len(amps) == 1 {
+		mux.Handle("/", amps[0].routes(cfg.EnableRaw, cfg.EnableUI))
+	}
+
+	if *cmd != "" {
+		if err := amps[0].runCommand(*cmd, *cmdWait, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var handler http.Handler = withJSONStyle(cfg.JSONStyle, mux)
+	if audit != nil {
+		handler = withAudit(audit, handler)
+	}
+	handler = withMaxBody(cfg.MaxBody, handler)
+	if cfg.IdempotencyTTL > 0 {
+		handler = withIdempotency(cfg.IdempotencyTTL, handler)
+	}
+	if cfg.RateLimit > 0 {
+		handler = withRateLimit(rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.RateBurst), handler)
+	}
+	if cfg.UserCooldown > 0 {
+		handler = withCooldown(realClock{}, cfg.UserCooldown, cfg.User != "", handler)
+	}
+	if cfg.User != "" {
+		handler = withBasicAuth(cfg.User, cfg.Pwd, handler)
+	}
+	if cfg.CORSOrigin != "" {
+		handler = withCORS(cfg.CORSOrigin, handler)
+	}
+
+	l, err := listenOn(cfg.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	for _, amp := range amps {
+		srv.RegisterOnShutdown(amp.stopStreams)
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
 
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	switch {
+	case cfg.TLSCert != "":
+		err = srv.ServeTLS(l, cfg.TLSCert, cfg.TLSKey)
+	case cfg.TLSSelfSigned:
+		cert, certErr := selfSignedCert()
+		if certErr != nil {
+			log.Fatal(certErr)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		err = srv.ServeTLS(l, "", "")
+	default:
+		err = srv.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 
-	wg.Wait()
+	for _, amp := range amps {
+		amp.stopSleep()
+		if err := amp.flushSource(); err != nil {
+			log.Printf("error, sending source: %v", err)
+		}
+		if err := amp.SaveState(); err != nil {
+			log.Printf("error, saving state: %v", err)
+		}
+		amp.Close()
+	}
+	stopAmps()
 }
@@ -0,0 +1,1806 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+func TestSendCommand(t *testing.T) {
+	tests := []struct {
+		cmd  Command
+		want string
+	}{
+		{GetPowerState, "#01,01\r"},
+		{SetPowerOn, "#01,02,1\r"},
+		{SetMuteOff, "#01,04,0\r"},
+		{SetSourceBluetooth, "#03,04,14\r"},
+		{GetFirmwareVersion, "#13,02\r"},
+	}
+	for _, tt := range tests {
+		port := newFakePort()
+		a := NewAmplifierWithPort(port)
+		if err := a.SendCommand(tt.cmd); err != nil {
+			t.Errorf("SendCommand(%v): %v", tt.cmd, err)
+			continue
+		}
+		if got := port.bytes(); got != tt.want {
+			t.Errorf("SendCommand(%v) wrote %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestReadUpdate(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	port := a.port.(*fakePort)
+
+	port.push("#02,01,1", "#02,03,1", "#04,01,05", "#14,02,2.1")
+	for range 4 {
+		if err := a.readUpdate(); err != nil {
+			t.Fatalf("readUpdate: %v", err)
+		}
+	}
+
+	st := a.State()
+	if !st.Power || !st.Mute || st.Source != "D2" || st.FirmwareVersion != "2.1" {
+		t.Errorf("State after replies = %+v, want on, muted on D2 with firmware 2.1", st)
+	}
+	if a.lastReplyTime.Load() == 0 {
+		t.Error("Last reply time not set")
+	}
+}
+
+func TestReadUpdateInvalid(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	port := a.port.(*fakePort)
+
+	port.push("garbage", "#02,01")
+	for range 2 {
+		if err := a.readUpdate(); err != nil {
+			t.Fatalf("readUpdate: %v", err)
+		}
+	}
+
+	if got := a.metrics.parseErrors.Load(); got != 1 {
+		t.Errorf("Parse errors = %d, want 1", got)
+	}
+	if st := a.State(); st.Power {
+		t.Errorf("State after invalid replies = %+v, want unchanged", st)
+	}
+}
+
+func TestReadUpdateUnmodeled(t *testing.T) {
+	logs := captureLog(t)
+	a := NewAmplifierWithPort(newFakePort())
+	a.debug = true
+	port := a.port.(*fakePort)
+
+	port.push("#99,42,7", "02;01", "#02,03,1")
+	for range 3 {
+		if err := a.readUpdate(); err != nil {
+			t.Fatalf("readUpdate: %v", err)
+		}
+	}
+
+	if got := a.metrics.parseErrors.Load(); got != 1 {
+		t.Errorf("Parse errors = %d, want 1, the unmodeled reply isn't one", got)
+	}
+	out := logs.String()
+	if !strings.Contains(out, `Debug: unhandled reply group 99 number 42, data "7"`) {
+		t.Errorf("Log %q, want the unhandled reply at debug", out)
+	}
+	if !strings.Contains(out, "Invalid reply format") {
+		t.Errorf("Log %q, want the parse error", out)
+	}
+	if st := a.State(); !st.Mute {
+		t.Errorf("State = %+v, want muted after the unmodeled reply", st)
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	a.mu.Lock()
+	a.state = AmplifierState{Power: true, Mute: true, Source: "D1"}
+	a.mu.Unlock()
+
+	tests := []struct {
+		reply Reply
+		check func(AmplifierState) bool
+		desc  string
+	}{
+		{Reply{Group: "04", Number: "01", Data: "14"}, func(st AmplifierState) bool { return st.Source == "Bluetooth" }, "source Bluetooth"},
+		{Reply{Group: "04", Number: "01", Data: "99"}, func(st AmplifierState) bool { return st.Source == "Bluetooth" }, "unknown source ignored"},
+		{Reply{Group: "02", Number: "03", Data: "0"}, func(st AmplifierState) bool { return !st.Mute }, "unmuted"},
+		{Reply{Group: "06", Number: "01", Data: "-3"}, func(st AmplifierState) bool { return st.Bass == -3 }, "bass -3"},
+		{Reply{Group: "02", Number: "01", Data: "0"}, func(st AmplifierState) bool { return !st.Power && st.Source == "" && !st.Mute }, "standby clears the source"},
+		{Reply{Group: "00", Number: "04"}, func(st AmplifierState) bool { return !st.Power }, "error reply ignored"},
+	}
+	for _, tt := range tests {
+		a.UpdateState(&tt.reply)
+		if st := a.State(); !tt.check(st) {
+			t.Errorf("After %v: state %+v, want %s", &tt.reply, st, tt.desc)
+		}
+	}
+}
+
+func TestQueryAll(t *testing.T) {
+	a, _ := newTestAmp(t)
+
+	st, err := a.QueryAll(context.Background())
+	if err != nil {
+		t.Fatalf("QueryAll: %v", err)
+	}
+	if !st.Power || st.Mute || st.Source != "D1" || st.ProtocolVersion != "1.0" {
+		t.Errorf("QueryAll = %+v, want on, unmuted on D1 with protocol 1.0", st)
+	}
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	a, port := newQueriedAmp(t)
+
+	// A burst of unsolicited replies, some split across reads, while
+	// commands are written and confirmed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			port.push("#02,37,4" + strconv.Itoa(i%10))
+			port.pushRaw("#04,01,")
+			port.pushRaw("04\r")
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if err := a.sendAndConfirm(context.Background(), GetPowerState); err != nil {
+					errs <- err
+				}
+				a.State()
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("sendAndConfirm: %v", err)
+	}
+	if got := len(port.commands()); got != 100 {
+		t.Errorf("Wrote %d commands, want 100", got)
+	}
+	waitFor(t, "the last replies", func() bool { return a.State().Temperature != nil })
+	if got := a.metrics.parseErrors.Load(); got != 0 {
+		t.Errorf("Parse errors = %d, want 0", got)
+	}
+	if st := a.State(); st.Source != "D1" || !st.Power {
+		t.Errorf("State = %+v, want on D1", st)
+	}
+}
+
+func TestReplyString(t *testing.T) {
+	tests := []struct {
+		reply Reply
+		want  string
+	}{
+		{Reply{Group: "02", Number: "01", Data: "1"}, "Current power state: On"},
+		{Reply{Group: "02", Number: "03", Data: "0"}, "Current mute state: Off"},
+		{Reply{Group: "04", Number: "01", Data: "14"}, "Current source: Bluetooth"},
+		{Reply{Group: "04", Number: "01", Data: "99"}, "Current source: 99"},
+		{Reply{Group: "14", Number: "02", Data: "2.1"}, "Get Firmware Version: 2.1"},
+		{Reply{Group: "00", Number: "04"}, "Command not available"},
+		{Reply{Group: "42", Number: "01", Data: "x"}, "Unknown reply: 42,01,x"},
+	}
+	for _, tt := range tests {
+		if got := tt.reply.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestToneCommands(t *testing.T) {
+	tests := []struct {
+		set   func(int) (Command, error)
+		level int
+		want  Command
+	}{
+		{SetBass, -10, Command{Group: "05", Number: "02", Data: "-10"}},
+		{SetTreble, 4, Command{Group: "05", Number: "04", Data: "4"}},
+		{SetBalance, 15, Command{Group: "05", Number: "06", Data: "15"}},
+	}
+	for _, tt := range tests {
+		got, err := tt.set(tt.level)
+		if err != nil || got != tt.want {
+			t.Errorf("Set(%d) = %v, %v, want %v", tt.level, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		set   func(int) (Command, error)
+		level int
+	}{{SetBass, 11}, {SetTreble, -11}, {SetBalance, 16}} {
+		if _, err := tt.set(tt.level); err == nil {
+			t.Errorf("Set(%d) succeeded, want out of range", tt.level)
+		}
+	}
+}
+
+func TestTone(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/status", `{"bass": -3, "balance": 5}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /status = %d %s", resp.StatusCode, body)
+	}
+	if st := a.State(); st.Bass != -3 || st.Balance != 5 || st.Treble != 0 {
+		t.Errorf("State = %+v, want bass -3, balance 5", st)
+	}
+	want := []Command{{Group: "05", Number: "02", Data: "-3"}, {Group: "05", Number: "06", Data: "5"}}
+	if got := port.commands(); !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+
+	resp, _ = request(t, srv, "POST", "/status", `{"treble": 12}`)
+	if resp.StatusCode != 400 {
+		t.Errorf("POST out of range treble = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	a, port := newTestAmp(t, func(a *Amplifier) {
+		a.clock = clock
+		a.healthStale = time.Minute
+	})
+	srv := serve(t, a)
+
+	port.push("#02,01,1")
+	waitFor(t, "the reply", func() bool { return a.lastReplyTime.Load() != 0 })
+
+	check := func(wantCode int, wantSerial string) {
+		t.Helper()
+		resp, body := request(t, srv, "GET", "/healthz", "")
+		if resp.StatusCode != wantCode || !strings.Contains(body, `"serial":"`+wantSerial+`"`) {
+			t.Errorf("GET /healthz = %d %s, want %d %s", resp.StatusCode, body, wantCode, wantSerial)
+		}
+	}
+	check(200, "connected")
+
+	clock.Advance(2 * time.Minute)
+	check(503, "stale")
+
+	a.setConnection(connError, errors.New("Port gone"))
+	check(503, "disconnected")
+}
+
+// timeoutPort is a fakePort whose reads time out after a while without data,
+// as the serial port does with a read timeout.
+type timeoutPort struct {
+	*fakePort
+	timeouts atomic.Int32
+}
+
+func (p *timeoutPort) Read(b []byte) (int, error) {
+	select {
+	case buf := <-p.reads:
+		return copy(b, buf), nil
+	case <-p.closed:
+		return 0, os.ErrClosed
+	case <-time.After(time.Millisecond):
+		p.timeouts.Add(1)
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	port := &timeoutPort{fakePort: newFakePort()}
+	a := NewAmplifierWithPort(port)
+	a.Start(context.Background())
+	defer a.Close()
+
+	waitFor(t, "read timeouts", func() bool { return port.timeouts.Load() >= 3 })
+	port.push("#02,03,1")
+	waitFor(t, "the reply", func() bool { return a.State().Mute })
+
+	if status, lastErr := a.connection(); status != connConnected {
+		t.Errorf("Connection after read timeouts = %s %s, want connected", status, lastErr)
+	}
+}
+
+func TestCommandValidate(t *testing.T) {
+	tests := []struct {
+		cmd Command
+		ok  bool
+	}{
+		{SetPowerOn, true},
+		{Command{Group: "03", Number: "06", Data: "04-3"}, true},
+		{Command{Group: "1", Number: "01"}, false},
+		{Command{Group: "01", Number: "1a"}, false},
+		{Command{Group: "001", Number: "01"}, false},
+		{Command{Group: "01", Number: "01", Data: "1,2"}, false},
+		{Command{Group: "01", Number: "01", Data: "1#01"}, false},
+		{Command{Group: "01", Number: "01", Data: "1\r#01,02,0"}, false},
+		{Command{Group: "01", Number: "01", Data: "a b"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v.Validate() = %v, want ok %v", tt.cmd, err, tt.ok)
+		}
+	}
+
+	port := newFakePort()
+	a := NewAmplifierWithPort(port)
+	if err := a.SendCommand(Command{Group: "01", Number: "02", Data: "1\r"}); err == nil {
+		t.Error("SendCommand with invalid data succeeded")
+	}
+	if got := port.bytes(); got != "" {
+		t.Errorf("Invalid command wrote %q", got)
+	}
+}
+
+func TestRawCommand(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/command", `{"group": "13", "number": "02"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /command = %d %s", resp.StatusCode, body)
+	}
+	var reply struct {
+		Group, Number, Data, Description string
+	}
+	if err := json.Unmarshal([]byte(body), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Group != "14" || reply.Number != "02" || reply.Data != "2.1" || reply.Description != "Get Firmware Version: 2.1" {
+		t.Errorf("Reply = %+v, want the firmware version", reply)
+	}
+	if got := port.commands(); len(got) != 1 || got[0] != GetFirmwareVersion {
+		t.Errorf("Sent %v, want %v", got, GetFirmwareVersion)
+	}
+
+	// Data which could inject a second command never reaches the port.
+	port.reset()
+	for _, data := range []string{`1\r#01,02,0`, `1,0`, `#01`, `1\n`, `1\u0000`} {
+		body := `{"group": "01", "number": "04", "data": "` + data + `"}`
+		if resp, out := request(t, srv, "POST", "/command", body); resp.StatusCode != 400 {
+			t.Errorf("POST /command %s = %d %s, want 400", body, resp.StatusCode, out)
+		}
+	}
+	if got := port.bytes(); got != "" {
+		t.Errorf("Injection attempts wrote %q", got)
+	}
+
+	resp, _ = request(t, srv, "GET", "/command", "")
+	if resp.StatusCode != 405 {
+		t.Errorf("GET /command = %d, want 405", resp.StatusCode)
+	}
+
+	// The endpoint is only served with -enable-raw.
+	disabled := httptest.NewServer(a.routes(false, false))
+	defer disabled.Close()
+	resp, _ = request(t, disabled, "POST", "/command", `{"group": "13", "number": "02"}`)
+	if resp.StatusCode != 404 {
+		t.Errorf("POST /command without -enable-raw = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestVersionState(t *testing.T) {
+	a, port := newTestAmp(t)
+	srv := serve(t, a)
+
+	port.push("#14,01,1.0", "#14,02,2.1")
+	waitFor(t, "the versions", func() bool { return a.State().FirmwareVersion != "" })
+
+	_, body := request(t, srv, "GET", "/status", "")
+	var st AmplifierState
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.ProtocolVersion != "1.0" || st.FirmwareVersion != "2.1" {
+		t.Errorf("GET /status versions = %q, %q, want 1.0, 2.1", st.ProtocolVersion, st.FirmwareVersion)
+	}
+}
+
+func TestWriteRetry(t *testing.T) {
+	tests := []struct {
+		failures int
+		err      error
+		attempts int
+		ok       bool
+	}{
+		{failures: 2, err: errors.New("Transient"), attempts: 3, ok: true},
+		{failures: 3, err: errors.New("Transient"), attempts: 3},
+		{failures: 1, err: os.ErrClosed, attempts: 1},
+	}
+	for _, tt := range tests {
+		port := newFakePort()
+		var attempts int
+		port.writeErr = func(Command) error {
+			attempts++
+			if attempts <= tt.failures {
+				return tt.err
+			}
+			return nil
+		}
+		a := NewAmplifierWithPort(port)
+		a.writeRetries = 2
+
+		err := a.SendCommand(GetPowerState)
+		if (err == nil) != tt.ok || attempts != tt.attempts {
+			t.Errorf("%d failures of %v: %v after %d attempts, want ok %v after %d", tt.failures, tt.err, err, attempts, tt.ok, tt.attempts)
+		}
+		var closed *ErrPortClosed
+		if errors.Is(tt.err, os.ErrClosed) && !errors.As(err, &closed) {
+			t.Errorf("Closed port error %v, want an *ErrPortClosed", err)
+		}
+	}
+}
+
+func TestSourceDebounce(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	a, port := newQueriedAmp(t, func(a *Amplifier) {
+		a.clock = clock
+		a.sourceDebounce = 300 * time.Millisecond
+	})
+
+	pending := func() Command {
+		a.sourceMu.Lock()
+		defer a.sourceMu.Unlock()
+		if a.pendingSource == nil {
+			return Command{}
+		}
+		return a.pendingSource.cmd
+	}
+	errs := make(chan error, 3)
+	for _, src := range []string{"D2", "A1", "D3"} {
+		go func() { errs <- a.handleSource(context.Background(), src) }()
+		want := sourcesByName[strings.ToLower(src)].Command
+		waitFor(t, src+" pending", func() bool { return pending() == want })
+		clock.Advance(100 * time.Millisecond)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v within the debounce window", got)
+	}
+
+	clock.Advance(300 * time.Millisecond)
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Errorf("handleSource: %v", err)
+		}
+	}
+	if got := port.commands(); !slices.Equal(got, []Command{SetSourceD3}) {
+		t.Errorf("Sent %v, want only %v", got, SetSourceD3)
+	}
+	if st := a.State(); st.Source != "D3" {
+		t.Errorf("Source = %s, want D3", st.Source)
+	}
+}
+
+func TestValidateListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{":8080", true},
+		{"127.0.0.1:9000", true},
+		{"[::1]:9000", true},
+		{"unix:/run/cxa81.sock", true},
+		{"8080", false},
+		{"localhost:http", false},
+		{"127.0.0.1:70000", false},
+		{"unix:", false},
+	}
+	for _, tt := range tests {
+		if err := validateListenAddr(tt.addr); (err == nil) != tt.ok {
+			t.Errorf("validateListenAddr(%q) = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+	}
+}
+
+func TestSourceTable(t *testing.T) {
+	for _, src := range sourceTable {
+		if got := sources[src.Code]; got != src.Name {
+			t.Errorf("sources[%s] = %q, want %q", src.Code, got, src.Name)
+		}
+		found, ok := lookupSource(src.Name)
+		if !ok || found.Code != src.Code {
+			t.Errorf("lookupSource(%q) = %+v, %v, want code %s", src.Name, found, ok, src.Code)
+		}
+		if src.Command.Data != src.Code {
+			t.Errorf("%s command data %q, want the code %s", src.Name, src.Command.Data, src.Code)
+		}
+	}
+}
+
+func TestLookupSource(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"d1", "D1"},
+		{" Bluetooth ", "Bluetooth"},
+		{"BT", "Bluetooth"},
+		{"usb audio", "USB"},
+		{"A1-Balanced", "A1 Balanced"},
+		{"a1 bal", "A1 Balanced"},
+		{"tape", ""},
+	}
+	for _, tt := range tests {
+		src, ok := lookupSource(tt.name)
+		if ok != (tt.want != "") || src.Name != tt.want {
+			t.Errorf("lookupSource(%q) = %q, %v, want %q", tt.name, src.Name, ok, tt.want)
+		}
+	}
+}
+
+func TestRejectedCommand(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+	port.onCommand(func(Command) []string { return []string{"#00,03"} })
+
+	before := a.State()
+	resp, body := request(t, srv, "POST", "/status", `{"mute": "on"}`)
+	if resp.StatusCode != 502 {
+		t.Errorf("POST rejected mute = %d %s, want 502", resp.StatusCode, body)
+	}
+	if st := a.State(); !reflect.DeepEqual(st, before) {
+		t.Errorf("State after a rejected command = %+v, want unchanged %+v", st, before)
+	}
+
+	err := a.sendAndConfirm(context.Background(), SetMuteOn)
+	var rejected *ErrCommandRejected
+	if !errors.As(err, &rejected) || rejected.Command != SetMuteOn || rejected.Reply.Number != "03" {
+		t.Errorf("sendAndConfirm = %v, want the mute rejected with a data error", err)
+	}
+}
+
+func TestNotAvailableQueriesPower(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+	// The amplifier went to standby without reporting it.
+	port.set(GetPowerState, "0")
+
+	resp, body := request(t, srv, "POST", "/status", `{"source": "D2"}`)
+	if resp.StatusCode != 409 {
+		t.Errorf("POST source not available = %d %s, want 409", resp.StatusCode, body)
+	}
+	waitFor(t, "the standby", func() bool { return !a.State().Power })
+	if got, want := port.commands(), []Command{SetSourceD2, GetPowerState}; !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+
+	// Commands available in standby don't trigger a query.
+	port.reset()
+	port.onCommand(func(Command) []string { return []string{"#00,04"} })
+	a.sendAndConfirm(context.Background(), GetFirmwareVersion)
+	time.Sleep(10 * time.Millisecond)
+	if got := port.commands(); !slices.Equal(got, []Command{GetFirmwareVersion}) {
+		t.Errorf("Sent %v, want only %v", got, GetFirmwareVersion)
+	}
+}
+
+// inStandby puts the fake amplifier in standby, as a newTestAmp option.
+func inStandby(a *Amplifier) {
+	a.port.(*fakePort).set(GetPowerState, "0")
+}
+
+func TestStandby(t *testing.T) {
+	a, port := newQueriedAmp(t, inStandby)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/status", `{"source": "D2"}`)
+	if resp.StatusCode != 409 {
+		t.Errorf("POST source in standby = %d %s, want 409", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v in standby, want nothing", got)
+	}
+
+	a, port = newQueriedAmp(t, inStandby, func(a *Amplifier) { a.wakeOnChange = true })
+	srv = serve(t, a)
+	resp, body = request(t, srv, "POST", "/status", `{"mute": "on"}`)
+	if resp.StatusCode != 200 {
+		t.Errorf("POST mute waking = %d %s, want 200", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) < 2 || got[0] != SetPowerOn || !slices.Contains(got[1:], SetMuteOn) {
+		t.Errorf("Sent %v, want power on then mute", got)
+	}
+	if st := a.State(); !st.Power || !st.Mute {
+		t.Errorf("State = %+v, want on and muted", st)
+	}
+}
+
+func TestMuteWake(t *testing.T) {
+	a, port := newQueriedAmp(t, inStandby)
+	srv := serve(t, a)
+
+	if resp, body := request(t, srv, "POST", "/mute", ""); resp.StatusCode != 409 {
+		t.Errorf("POST /mute in standby = %d %s, want 409", resp.StatusCode, body)
+	}
+	if resp, body := request(t, srv, "POST", "/mute?wake=maybe", ""); resp.StatusCode != 400 {
+		t.Errorf("POST /mute?wake=maybe = %d %s, want 400", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v without waking, want nothing", got)
+	}
+
+	resp, body := request(t, srv, "POST", "/mute?wake=true", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("POST /mute?wake=true = %d %s, want 200", resp.StatusCode, body)
+	}
+	got := port.commands()
+	if i := slices.Index(got, SetMuteOn); len(got) == 0 || got[0] != SetPowerOn || i < 0 {
+		t.Errorf("Sent %v, want power on then mute", got)
+	}
+	if st := a.State(); !st.Power || !st.Mute {
+		t.Errorf("State = %+v, want on and muted", st)
+	}
+
+	// Already on, waking doesn't power on again.
+	waitFor(t, "the power on queries", func() bool { return slices.Contains(port.commands(), GetMuteState) })
+	if err := a.sendAndConfirm(context.Background(), GetPowerState); err != nil {
+		t.Fatal(err)
+	}
+	port.reset()
+	if resp, body := request(t, srv, "POST", "/mute?wake=true", `{"mute": "off"}`); resp.StatusCode != 200 {
+		t.Errorf("POST /mute?wake=true when on = %d %s, want 200", resp.StatusCode, body)
+	}
+	if got := port.commands(); !slices.Equal(got, []Command{SetMuteOff}) {
+		t.Errorf("Sent %v when on, want %v", got, SetMuteOff)
+	}
+}
+
+func TestChangedAt(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	a := NewAmplifierWithPort(newFakePort())
+	a.clock = clock
+
+	a.UpdateState(&Reply{Group: "02", Number: "03", Data: "1"})
+	if at := a.State().MuteChangedAt; at == nil || !at.Equal(start) {
+		t.Fatalf("Mute changed at %v, want %v", at, start)
+	}
+	if st := a.State(); st.PowerChangedAt != nil || st.SourceChangedAt != nil {
+		t.Errorf("Unchanged power and source have timestamps: %v, %v", st.PowerChangedAt, st.SourceChangedAt)
+	}
+
+	clock.Advance(time.Minute)
+	a.UpdateState(&Reply{Group: "02", Number: "03", Data: "1"})
+	if at := a.State().MuteChangedAt; !at.Equal(start) {
+		t.Errorf("Mute changed at %v after the same mute, want %v", at, start)
+	}
+
+	a.UpdateState(&Reply{Group: "02", Number: "03", Data: "0"})
+	if at := a.State().MuteChangedAt; !at.Equal(start.Add(time.Minute)) {
+		t.Errorf("Mute changed at %v after unmuting, want %v", at, start.Add(time.Minute))
+	}
+}
+
+func TestSpeakerOutput(t *testing.T) {
+	a, port := newQueriedAmp(t)
+
+	for _, tt := range []struct {
+		value string
+		cmd   Command
+		want  string
+	}{{"B", SetSpeakerB, "B"}, {"a+b", SetSpeakerAB, "AB"}, {"A", SetSpeakerA, "A"}} {
+		port.reset()
+		if err := a.handleSpeakers(context.Background(), tt.value); err != nil {
+			t.Errorf("handleSpeakers(%q): %v", tt.value, err)
+			continue
+		}
+		if got := port.commands(); !slices.Equal(got, []Command{tt.cmd}) {
+			t.Errorf("handleSpeakers(%q) sent %v, want %v", tt.value, got, tt.cmd)
+		}
+		if got := a.State().SpeakerOutput; got != tt.want {
+			t.Errorf("handleSpeakers(%q): speaker output %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	if err := a.handleSpeakers(context.Background(), "C"); err == nil {
+		t.Error("handleSpeakers(C) succeeded")
+	}
+	a.UpdateState(&Reply{Group: "02", Number: "24", Data: "7"})
+	if got := a.State().SpeakerOutput; got != "A" {
+		t.Errorf("Speaker output %q after an invalid reply, want A", got)
+	}
+}
+
+func TestConnectedOutputs(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+
+	a.UpdateState(&Reply{Group: "02", Number: "26", Data: "1"})
+	a.UpdateState(&Reply{Group: "02", Number: "27", Data: "1"})
+	if st := a.State(); !st.HeadphonesConnected || !st.SpeakersConnected {
+		t.Errorf("State = %+v, want headphones and speakers connected", st)
+	}
+
+	a.UpdateState(&Reply{Group: "02", Number: "26", Data: "0"})
+	if st := a.State(); st.HeadphonesConnected || !st.SpeakersConnected {
+		t.Errorf("State = %+v, want the headphones unplugged", st)
+	}
+	if got := (&Reply{Group: "02", Number: "27", Data: "0"}).String(); got != "Speakers: Disconnected" {
+		t.Errorf("Speakers reply = %q", got)
+	}
+}
+
+func TestCommandGap(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	port := newFakePort()
+	a := NewAmplifierWithPort(port)
+	a.clock = clock
+	a.commandGap = 50 * time.Millisecond
+
+	if err := a.SendCommand(GetPowerState); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- a.SendCommand(GetMuteState) }()
+	waitFor(t, "the gap wait", func() bool { return clock.pending() == 1 })
+
+	clock.Advance(30 * time.Millisecond)
+	if got := len(port.commands()); got != 1 {
+		t.Errorf("Sent %d commands within the gap, want 1", got)
+	}
+	clock.Advance(20 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := len(port.commands()); got != 2 {
+		t.Errorf("Sent %d commands after the gap, want 2", got)
+	}
+
+	// No wait once the gap elapsed.
+	clock.Advance(time.Second)
+	if err := a.SendCommand(GetSource); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeSources(t *testing.T) {
+	for _, tt := range []struct {
+		model   string
+		has     []string
+		missing []string
+	}{
+		{CXA81, []string{"A1", "D1", "MP3", "USB", "A1 Balanced"}, nil},
+		{CXA61, []string{"A1", "D1", "Bluetooth"}, []string{"MP3", "USB", "A1 Balanced"}},
+	} {
+		a, _ := newQueriedAmp(t, func(a *Amplifier) { a.model = tt.model })
+		_, body := request(t, serve(t, a), "GET", "/api/sources", "")
+
+		var list []struct {
+			Name     string
+			Selected bool
+		}
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(list))
+		for i, src := range list {
+			names[i] = src.Name
+			if src.Selected != (src.Name == "D1") {
+				t.Errorf("%s: %s selected %v, want only D1", tt.model, src.Name, src.Selected)
+			}
+		}
+		for _, name := range tt.has {
+			if !slices.Contains(names, name) {
+				t.Errorf("%s sources %v, missing %s", tt.model, names, name)
+			}
+		}
+		for _, name := range tt.missing {
+			if slices.Contains(names, name) {
+				t.Errorf("%s sources %v, include %s", tt.model, names, name)
+			}
+		}
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/status", `{"power": "maybe"}`, 400},
+		{"POST", "/status", `not json`, 400},
+		{"GET", "/status?fields=volume", "", 400},
+		{"POST", "/status", `{"source": "tape"}`, 400},
+	} {
+		resp, body := request(t, srv, tt.method, tt.path, tt.body)
+		var e struct{ Error string }
+		if resp.StatusCode != tt.code || resp.Header.Get("Content-Type") != "application/json" || json.Unmarshal([]byte(body), &e) != nil || e.Error == "" {
+			t.Errorf("%s %s %s = %d %s %s, want %d with a JSON error", tt.method, tt.path, tt.body, resp.StatusCode, resp.Header.Get("Content-Type"), body, tt.code)
+		}
+	}
+}
+
+func TestUnsolicitedPower(t *testing.T) {
+	a, port := newQueriedAmp(t)
+
+	// The amplifier going to standby by itself, e.g. after auto power down.
+	port.push("#02,01,0")
+	waitFor(t, "standby", func() bool { return !a.State().Power })
+	if st := a.State(); st.Source != "" || st.Mute {
+		t.Errorf("State in standby = %+v, want the source and mute cleared", st)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v on standby, want nothing", got)
+	}
+
+	port.push("#02,01,1")
+	waitFor(t, "the source", func() bool { return a.State().Source == "D1" })
+	if got := port.commands(); !slices.Contains(got, GetSource) || !slices.Contains(got, GetMuteState) {
+		t.Errorf("Sent %v after power on, want the source and mute queried", got)
+	}
+}
+
+func TestWakeQueriesWaitForCommands(t *testing.T) {
+	a, port := newQueriedAmp(t, inStandby)
+	port.set(GetPowerState, "1")
+
+	a.cmdMu.Lock()
+	port.push("#02,01,1")
+	waitFor(t, "power on", func() bool { return a.State().Power })
+	time.Sleep(10 * time.Millisecond)
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v while a command awaited its reply", got)
+	}
+	a.cmdMu.Unlock()
+
+	waitFor(t, "the source", func() bool { return a.State().Source == "D1" })
+	if got, want := port.commands(), []Command{GetSource, GetMuteState}; !slices.Equal(got, want) {
+		t.Errorf("Sent %v after power on, want %v", got, want)
+	}
+}
+
+func TestToggle(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, want := range []bool{true, false} {
+		resp, body := request(t, srv, "POST", "/mute/toggle", "")
+		if resp.StatusCode != 200 || a.State().Mute != want {
+			t.Errorf("POST /mute/toggle = %d %s, want mute %v", resp.StatusCode, body, want)
+		}
+	}
+
+	resp, body := request(t, srv, "POST", "/power/toggle", "")
+	if resp.StatusCode != 200 || a.State().Power {
+		t.Errorf("POST /power/toggle = %d %s, want standby", resp.StatusCode, body)
+	}
+}
+
+func TestCycleSource(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, tt := range []struct{ path, want string }{
+		{"/source/next", "D2"},
+		{"/source/next", "D3"},
+		{"/source/prev", "D2"},
+	} {
+		resp, body := request(t, srv, "POST", tt.path, "")
+		if resp.StatusCode != 200 || !strings.Contains(body, `"source":"`+tt.want+`"`) {
+			t.Errorf("POST %s = %d %s, want source %s", tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+	want := []Command{GetNextSource, GetNextSource, GetPreviousSource}
+	if got := port.commands(); !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+}
+
+func TestServeVersion(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	_, body := request(t, serve(t, a), "GET", "/version", "")
+
+	var v struct {
+		Version, GoVersion, ProtocolVersion, FirmwareVersion string
+	}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != version || v.GoVersion != runtime.Version() || v.ProtocolVersion != "1.0" || v.FirmwareVersion != "2.1" {
+		t.Errorf("GET /version = %+v", v)
+	}
+}
+
+func TestMultipleAmplifiers(t *testing.T) {
+	living, livingPort := newQueriedAmp(t)
+	office, officePort := newQueriedAmp(t)
+	mux := http.NewServeMux()
+	for name, a := range map[string]*Amplifier{"living": living, "office": office} {
+		prefix := "/amp/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, a.routes(false, false)))
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, body := request(t, srv, "POST", "/amp/living/status", `{"mute": "on", "source": "D2"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /amp/living/status = %d %s", resp.StatusCode, body)
+	}
+	if st := living.State(); !st.Mute || st.Source != "D2" {
+		t.Errorf("Living room state = %+v, want muted on D2", st)
+	}
+	if st := office.State(); st.Mute || st.Source != "D1" {
+		t.Errorf("Office state = %+v, want unchanged", st)
+	}
+	if got := officePort.commands(); len(got) != 0 {
+		t.Errorf("Sent %v to the office amplifier", got)
+	}
+	if got := livingPort.commands(); len(got) != 2 {
+		t.Errorf("Sent %v to the living room amplifier, want the mute and source", got)
+	}
+
+	_, body = request(t, srv, "GET", "/amp/office/source", "")
+	if !strings.Contains(body, "D1") {
+		t.Errorf("GET /amp/office/source = %s, want D1", body)
+	}
+}
+
+func TestUnchangedSkipped(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/status", `{"power": "on", "mute": "off", "source": "D1"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /status = %d %s", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v for the current values, want nothing", got)
+	}
+
+	a, port = newQueriedAmp(t, func(a *Amplifier) { a.alwaysSend = true })
+	request(t, serve(t, a), "POST", "/status", `{"mute": "off"}`)
+	if got := port.commands(); !slices.Equal(got, []Command{SetMuteOff}) {
+		t.Errorf("Sent %v with -always-send, want %v", got, SetMuteOff)
+	}
+}
+
+// blockingPort is a fakePort whose writes block until released.
+type blockingPort struct {
+	*fakePort
+	release chan struct{}
+}
+
+func (p *blockingPort) Write(b []byte) (int, error) {
+	<-p.release
+	return p.fakePort.Write(b)
+}
+
+func TestSendCommandCancel(t *testing.T) {
+	port := &blockingPort{fakePort: newFakePort(), release: make(chan struct{})}
+	a := NewAmplifierWithPort(port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.SendCommandContext(ctx, GetPowerState); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Blocked write = %v, want the deadline exceeded", err)
+	}
+
+	// The next write waits for the abandoned one so they don't interleave.
+	done := make(chan error)
+	go func() { done <- a.SendCommand(GetMuteState) }()
+	close(port.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := port.bytes(); got != "#01,01\r#01,03\r" {
+		t.Errorf("Wrote %q, want the abandoned write then the next one", got)
+	}
+}
+
+func TestCloseBlockedWrite(t *testing.T) {
+	port := &blockingPort{fakePort: newFakePort(), release: make(chan struct{})}
+	defer close(port.release)
+	a := NewAmplifierWithPort(port)
+
+	go a.SendCommand(GetPowerState)
+	time.Sleep(10 * time.Millisecond)
+
+	// The blocked write holds writeMu, which closing doesn't wait for.
+	closed := make(chan struct{})
+	go func() {
+		a.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by a pending write")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	a, port := newTestAmp(t, func(a *Amplifier) { a.dryRun = true })
+	srv := serve(t, a)
+	a.UpdateState(&Reply{Group: "02", Number: "01", Data: "1"})
+
+	resp, body := request(t, srv, "POST", "/status", `{"mute": "on", "source": "D2"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /status in dry run = %d %s", resp.StatusCode, body)
+	}
+	if got := port.bytes(); got != "" {
+		t.Errorf("Wrote %q in dry run, want nothing", got)
+	}
+	if st := a.State(); !st.Mute || st.Source != "D2" {
+		t.Errorf("State = %+v, want the simulated mute and source", st)
+	}
+}
+
+func TestDryRunReplies(t *testing.T) {
+	a, port := newTestAmp(t, func(a *Amplifier) { a.dryRun = true })
+	srv := serve(t, a)
+
+	for _, tt := range []struct {
+		method, path string
+		want         string
+	}{
+		{"POST", "/refresh", `"source":"D1"`},
+		{"POST", "/source/next", `"source":"D2"`},
+		{"POST", "/source/prev", `"source":"D1"`},
+		{"GET", "/settings/max-volume", `{"volume":100}`},
+		{"GET", "/display/brightness", `{"brightness":2}`},
+		{"GET", "/source/D1/trim", `"trim":0`},
+	} {
+		resp, body := request(t, srv, tt.method, tt.path, "")
+		if resp.StatusCode != 200 || !strings.Contains(body, tt.want) {
+			t.Errorf("%s %s in dry run = %d %s, want %s", tt.method, tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+	if got := port.bytes(); got != "" {
+		t.Errorf("Wrote %q in dry run, want nothing", got)
+	}
+
+	// Queries needing power are rejected in standby, as by the amplifier.
+	if err := a.sendAndConfirm(context.Background(), SetPowerStandby); err != nil {
+		t.Fatal(err)
+	}
+	var rejected *ErrCommandRejected
+	if err := a.sendAndConfirm(context.Background(), GetSource); !errors.As(err, &rejected) {
+		t.Errorf("Source query in standby = %v, want it rejected", err)
+	}
+}
+
+func TestConnectionStatus(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	_, body := request(t, srv, "GET", "/status", "")
+	if !strings.Contains(body, `"connection":"connected"`) || strings.Contains(body, "lastError") {
+		t.Errorf("GET /status = %s, want connected without error", body)
+	}
+
+	port.Close()
+	waitFor(t, "the read error", func() bool { status, _ := a.connection(); return status == connError })
+	_, body = request(t, srv, "GET", "/status", "")
+	var st statusResponse
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Connection != connError || !strings.Contains(st.LastError, os.ErrClosed.Error()) {
+		t.Errorf("GET /status after the port closed = %s, want the error", body)
+	}
+}
+
+func TestReadUpdatePartial(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	port := a.port.(*fakePort)
+	replies, cancel := a.watchReplies()
+	defer cancel()
+
+	port.pushRaw("#02,01,1\r#02,03,1\r#04,01,0")
+	if err := a.readUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(a.history.list()); got != 2 {
+		t.Errorf("%d replies after two and a half, want 2", got)
+	}
+	port.pushRaw("5\r")
+	if err := a.readUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for len(replies) > 0 {
+		got = append(got, (<-replies).String())
+	}
+	want := []string{"Current power state: On", "Current mute state: On", "Current source: D2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Replies %q, want each once: %q", got, want)
+	}
+	if st := a.State(); st.Source != "D2" || !st.Mute {
+		t.Errorf("State = %+v, want muted on D2", st)
+	}
+}
+
+func TestSetRequestValidate(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, tt := range []struct {
+		body string
+		want []string
+	}{
+		{`{"volume": 3}`, []string{"unknown field", "volume"}},
+		{`{"power": "maybe", "mute": "loud", "bass": 20}`, []string{"power state maybe", "mute state loud", "Bass 20"}},
+		{`{"source": "", "speakerOutput": "C"}`, []string{"Empty Source", "speaker output C"}},
+	} {
+		resp, body := request(t, srv, "POST", "/status", tt.body)
+		if resp.StatusCode != 400 {
+			t.Errorf("POST %s = %d, want 400", tt.body, resp.StatusCode)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("POST %s = %s, want the error %q", tt.body, body, want)
+			}
+		}
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v for invalid requests", got)
+	}
+}
+
+func TestPartialUpdate(t *testing.T) {
+	for _, tt := range []struct {
+		field, value string
+		want         Command
+	}{
+		{"power", "off", SetPowerStandby},
+		{"mute", "on", SetMuteOn},
+		{"source", "D2", SetSourceD2},
+		{"speakerOutput", "B", SetSpeakerB},
+	} {
+		a, port := newQueriedAmp(t)
+		srv := serve(t, a)
+
+		// Omitted fields are left unchanged.
+		if resp, _ := request(t, srv, "POST", "/status", `{}`); resp.StatusCode != 200 {
+			t.Errorf("POST {} = %d, want 200", resp.StatusCode)
+		}
+		if got := port.commands(); len(got) != 0 {
+			t.Errorf("POST {} sent %v, want nothing", got)
+		}
+
+		body := fmt.Sprintf(`{%q: ""}`, tt.field)
+		resp, got := request(t, srv, "POST", "/status", body)
+		if resp.StatusCode != 400 || !strings.Contains(got, "Empty") {
+			t.Errorf("POST %s = %d %s, want the empty value rejected", body, resp.StatusCode, got)
+		}
+		if got := port.commands(); len(got) != 0 {
+			t.Errorf("POST %s sent %v, want nothing", body, got)
+		}
+
+		body = fmt.Sprintf(`{%q: %q}`, tt.field, tt.value)
+		if resp, got := request(t, srv, "POST", "/status", body); resp.StatusCode != 200 {
+			t.Errorf("POST %s = %d %s, want 200", body, resp.StatusCode, got)
+		}
+		if got := port.commands(); !slices.Contains(got, tt.want) {
+			t.Errorf("POST %s sent %v, want %v", body, got, tt.want)
+		}
+	}
+}
+
+func TestStartAmplifierSendError(t *testing.T) {
+	port := newFakePort()
+	port.writeErr = func(Command) error { return errors.New("Write failed") }
+	stubOpenPort(t, func(string, *serial.Mode) (serial.Port, error) { return fakeSerial{port}, nil })
+
+	a, err := startAmplifier(context.Background(), context.Background(), testConfig("/dev/ttyFAKE"))
+	if err != nil {
+		t.Fatalf("startAmplifier with failing queries: %v", err)
+	}
+	defer a.Close()
+
+	resp, _ := request(t, serve(t, a), "GET", "/healthz", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("GET /healthz = %d, want the server up", resp.StatusCode)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	logs := captureLog(t)
+	stubOpenPort(t, fakeOpener)
+	cfg := testConfig("/dev/ttyFAKE")
+	cfg.SelfTestFatal = true
+	a, err := startAmplifier(context.Background(), context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("startAmplifier with a replying amplifier: %v", err)
+	}
+	a.Close()
+	if !strings.Contains(logs.String(), "Self-test passed") {
+		t.Errorf("Log %q, want the self-test passed", logs)
+	}
+
+	// An amplifier which doesn't reply fails the self-test.
+	stubOpenPort(t, func(string, *serial.Mode) (serial.Port, error) {
+		port := newFakePort()
+		port.onCommand(func(Command) []string { return nil })
+		return fakeSerial{port}, nil
+	})
+	_, err = startAmplifier(context.Background(), context.Background(), cfg)
+	var timeout *ErrReplyTimeout
+	if !errors.As(err, &timeout) || timeout.Command != GetProtocolVersion || !strings.HasPrefix(err.Error(), "Self-test failed") {
+		t.Errorf("startAmplifier without replies = %v, want the self-test failed", err)
+	}
+
+	// Unless fatal the amplifier is started anyway.
+	cfg.SelfTestFatal, cfg.SelfTest = false, true
+	a, err = startAmplifier(context.Background(), context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("startAmplifier with a non fatal self-test: %v", err)
+	}
+	a.Close()
+	if !strings.Contains(logs.String(), "warning, self-test failed") {
+		t.Errorf("Log %q, want the self-test failure", logs)
+	}
+}
+
+func TestDetectModel(t *testing.T) {
+	for reported, want := range map[string]string{
+		"CXA81":      CXA81,
+		"CXA81 MkII": CXA81,
+		"cxa 61":     CXA61,
+		"CXN":        "",
+		"":           "",
+	} {
+		if got, ok := detectModel(reported); got != want || ok != (want != "") {
+			t.Errorf("detectModel(%q) = %q, %v, want %q", reported, got, ok, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		reported string // The GetModel reply data, empty if rejected
+		want     string
+	}{
+		{"CXA61", CXA61},
+		{"CXA81 MkII", CXA81},
+		{"CXN", CXA81},
+		{"", CXA81},
+	} {
+		stubOpenPort(t, func(string, *serial.Mode) (serial.Port, error) {
+			port := newFakePort()
+			if tt.reported == "" {
+				port.onCommand(func(c Command) []string {
+					if c == GetModel {
+						return []string{"#00,02"}
+					}
+					port.mu.Lock()
+					defer port.mu.Unlock()
+					return port.emulate(c)
+				})
+			}
+			port.set(GetModel, tt.reported)
+			return fakeSerial{port}, nil
+		})
+		cfg := testConfig("/dev/ttyFAKE")
+		cfg.ExtendedQueries = true
+		a, err := startAmplifier(context.Background(), context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("Reported %q: startAmplifier: %v", tt.reported, err)
+		}
+		a.Close()
+		if a.model != tt.want {
+			t.Errorf("Reported %q: model %s, want %s", tt.reported, a.model, tt.want)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	a, port := newTestAmp(t, func(a *Amplifier) {
+		a.state.Power = true
+		a.pollInterval = time.Millisecond
+		a.sourceDebounce = time.Hour
+	})
+
+	pending := make(chan error)
+	go func() { pending <- a.handleSource(context.Background(), "D2") }()
+	waitFor(t, "the pending source", func() bool {
+		a.sourceMu.Lock()
+		defer a.sourceMu.Unlock()
+		return a.pendingSource != nil
+	})
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	var closed *ErrPortClosed
+	if err := <-pending; !errors.As(err, &closed) {
+		t.Errorf("Pending source change = %v, want the port closed", err)
+	}
+	select {
+	case <-port.closed:
+	default:
+		t.Error("Port not closed")
+	}
+
+	// The poll loop stopped with the port.
+	sent := len(port.commands())
+	time.Sleep(10 * time.Millisecond)
+	if got := len(port.commands()); got != sent {
+		t.Errorf("Sent %d commands after Close", got-sent)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("Second Close: %v", err)
+	}
+}
+
+func TestVerifySource(t *testing.T) {
+	for _, tt := range []struct {
+		misses int
+		ok     bool
+	}{{0, true}, {1, true}, {2, false}} {
+		a, port := newQueriedAmp(t, func(a *Amplifier) {
+			a.verifySource = true
+			a.confirmTimeout = 20 * time.Millisecond
+		})
+		// The amplifier lands on D3 for the first misses.
+		var sets int
+		source := "04"
+		port.onCommand(func(c Command) []string {
+			if c == SetSourceD2 {
+				if sets++; sets <= tt.misses {
+					source = "06"
+				} else {
+					source = "05"
+				}
+			}
+			return []string{"#04,01," + source}
+		})
+
+		err := a.handleSource(context.Background(), "D2")
+		if (err == nil) != tt.ok {
+			t.Errorf("%d misses: %v, want ok %v", tt.misses, err, tt.ok)
+		}
+		want := []Command{SetSourceD2, GetSource}
+		if tt.misses > 0 {
+			want = append(want, SetSourceD2, GetSource)
+		}
+		if got := port.commands(); !slices.Equal(got, want) {
+			t.Errorf("%d misses: sent %v, want %v", tt.misses, got, want)
+		}
+	}
+}
+
+func TestStatusFields(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, tt := range []struct {
+		fields string
+		want   map[string]any
+	}{
+		{"power", map[string]any{"power": true}},
+		{"source,mute,connection", map[string]any{"source": "D1", "mute": false, "connection": "connected"}},
+		{"temperature", map[string]any{"temperature": nil}},
+	} {
+		resp, body := request(t, srv, "GET", "/status?fields="+tt.fields, "")
+		var got map[string]any
+		if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("GET ?fields=%s = %d %s", tt.fields, resp.StatusCode, body)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GET ?fields=%s = %v, want %v", tt.fields, got, tt.want)
+		}
+	}
+
+	resp, body := request(t, srv, "GET", "/status?fields=power,volume", "")
+	if resp.StatusCode != 400 || !strings.Contains(body, "volume") {
+		t.Errorf("GET ?fields=power,volume = %d %s, want 400 naming volume", resp.StatusCode, body)
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	a, port := newQueriedAmp(t, func(a *Amplifier) { a.confirmTimeout = 20 * time.Millisecond })
+	srv := serve(t, a)
+	port.onCommand(func(Command) []string { return nil })
+
+	resp, body := request(t, srv, "POST", "/status", `{"mute": "on"}`)
+	if resp.StatusCode != 504 {
+		t.Errorf("POST without a reply = %d %s, want 504", resp.StatusCode, body)
+	}
+	if a.State().Mute {
+		t.Error("Muted without a confirmation")
+	}
+	if _, timeouts := a.metrics.counts(); timeouts["01"] != 1 {
+		t.Errorf("Timeouts = %v, want 1 for group 01", timeouts)
+	}
+}
+
+func TestConfirms(t *testing.T) {
+	for _, tt := range []struct {
+		reply string
+		cmd   Command
+		want  bool
+	}{
+		{"#02,01,1", SetPowerOn, true},
+		{"#02,01,0", SetPowerOn, false},
+		{"#02,01,0", SetPowerStandby, true},
+		{"#02,03,1", SetMuteOn, true},
+		{"#02,03,0", SetMuteOn, false},
+		{"#04,01,05", SetSourceD2, true},
+		{"#04,01,04", SetSourceD2, false},
+		{"#02,24,2", SetSpeakerB, true},
+		{"#02,24,0", SetSpeakerB, false},
+		{"#02,32,050", Command{Group: "01", Number: "33", Data: "50"}, true},
+		{"#02,34,40", Command{Group: "01", Number: "35", Data: "50"}, false},
+		{"#04,01,06", GetNextSource, true},
+		{"#06,01,-3", Command{Group: "05", Number: "02", Data: "-3"}, true},
+		{"#02,01,1", SetMuteOn, false},
+		{"#04,01,05", GetPowerState, false},
+	} {
+		m := validReply.FindStringSubmatch(tt.reply)
+		r := &Reply{Group: m[1], Number: m[2], Data: m[3]}
+		if got := confirms(r, tt.cmd); got != tt.want {
+			t.Errorf("confirms(%s, %v) = %v, want %v", tt.reply, tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestStaleReplyNotConfirming(t *testing.T) {
+	a, port := newQueriedAmp(t, inStandby, func(a *Amplifier) { a.confirmTimeout = 20 * time.Millisecond })
+	// The answer to a poll sent just before the command.
+	port.onCommand(func(Command) []string { return []string{"#02,01,0"} })
+
+	var timeout *ErrReplyTimeout
+	if err := a.sendAndConfirm(context.Background(), SetPowerOn); !errors.As(err, &timeout) {
+		t.Errorf("sendAndConfirm with a standby reply = %v, want a timeout", err)
+	}
+	if a.State().Power {
+		t.Error("Powered on by a standby reply")
+	}
+}
+
+func TestQueryStateWaitsForCommands(t *testing.T) {
+	a, port := newQueriedAmp(t)
+
+	a.cmdMu.Lock()
+	done := make(chan error)
+	go func() { done <- a.QueryState(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v while a command awaited its reply", got)
+	}
+	a.cmdMu.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("QueryState: %v", err)
+	}
+	if got, want := port.commands(), a.stateQueries(); !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+}
+
+func TestBluetoothPairing(t *testing.T) {
+	if want := (Command{Group: "03", Number: "07"}); SetBluetoothPairing != want {
+		t.Errorf("SetBluetoothPairing = %v, want %v", SetBluetoothPairing, want)
+	}
+
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/source/bluetooth/pair", "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(body, "the source is D1") {
+		t.Errorf("POST /source/bluetooth/pair on D1 = %d %s, want 409", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v on D1, want nothing", got)
+	}
+
+	port.push("#04,01,14")
+	waitFor(t, "the Bluetooth source", func() bool { return a.State().Source == "Bluetooth" })
+	resp, body = request(t, srv, "POST", "/source/bluetooth/pair", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("POST /source/bluetooth/pair = %d %s", resp.StatusCode, body)
+	}
+	if got := port.commands(); !slices.Equal(got, []Command{SetBluetoothPairing}) {
+		t.Errorf("Sent %v, want %v", got, SetBluetoothPairing)
+	}
+	if !a.State().BluetoothPairing {
+		t.Error("BluetoothPairing = false after pairing, want true")
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	for ending, term := range map[string]string{"cr": "\r", "lf": "\n", "crlf": "\r\n"} {
+		port := newFakePort()
+		port.terminator = term
+		a := NewAmplifierWithPort(port)
+		a.terminator = lineEndings[ending]
+
+		if err := a.SendCommand(SetMuteOn); err != nil {
+			t.Fatalf("%s: SendCommand: %v", ending, err)
+		}
+		if got, want := port.bytes(), "#01,04,1"+term; got != want {
+			t.Errorf("%s: wrote %q, want %q", ending, got, want)
+		}
+
+		port.pushRaw("#04,01,05" + term + "#02,01,1" + term)
+		for range 2 {
+			if err := a.readUpdate(); err != nil {
+				t.Fatalf("%s: readUpdate: %v", ending, err)
+			}
+		}
+		if st := a.State(); !st.Mute || !st.Power || st.Source != "D2" {
+			t.Errorf("%s: state %+v, want on and muted on D2", ending, st)
+		}
+		if got := a.metrics.parseErrors.Load(); got != 0 {
+			t.Errorf("%s: %d parse errors, want 0", ending, got)
+		}
+	}
+}
+
+func TestStateSnapshot(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range 500 {
+			a.UpdateState(&Reply{Group: "02", Number: "03", Data: strconv.Itoa(i % 2)})
+			a.UpdateState(&Reply{Group: "02", Number: "37", Data: strconv.Itoa(40 + i%10)})
+			a.UpdateState(&Reply{Group: "04", Number: "05", Data: "05+" + strconv.Itoa(i%6)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 500 {
+			st := a.State()
+			// The copy doesn't share the maps and pointers.
+			if st.Temperature != nil {
+				*st.Temperature = -1
+			}
+			if st.Trims != nil {
+				st.Trims["D2"] = -1
+			}
+		}
+	}()
+	wg.Wait()
+
+	st := a.State()
+	if st.Temperature == nil || *st.Temperature != 49 {
+		t.Errorf("Temperature = %v, want 49", st.Temperature)
+	}
+	if st.Trims["D2"] != 1 {
+		t.Errorf("Trims = %v, want D2 at 1", st.Trims)
+	}
+}
+
+func TestParsePaddedReply(t *testing.T) {
+	for _, tt := range []struct {
+		frame string
+		want  Reply
+	}{
+		{"#02,01,1", Reply{Group: "02", Number: "01", Data: "1"}},
+		{"#02,01,1\x00\x00", Reply{Group: "02", Number: "01", Data: "1"}},
+		{"  #14,02,2.1  ", Reply{Group: "14", Number: "02", Data: "2.1"}},
+		{"\x00#04,01,05 \x00\t", Reply{Group: "04", Number: "01", Data: "05"}},
+		{"#14,03,CXA81 \x00", Reply{Group: "14", Number: "03", Data: "CXA81"}},
+		{"#04,05,05-3\x00", Reply{Group: "04", Number: "05", Data: "05-3"}},
+		{"\n#00,04", Reply{Group: "00", Number: "04"}},
+	} {
+		got, err := parseReply(tt.frame)
+		if err != nil || *got != tt.want {
+			t.Errorf("parseReply(%q) = %+v, %v, want %+v", tt.frame, got, err, tt.want)
+		}
+	}
+
+	a := NewAmplifierWithPort(newFakePort())
+	port := a.port.(*fakePort)
+	port.pushRaw("#02,03,1\x00\x00\r  #04,01,05  \r")
+	if err := a.readUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if st := a.State(); !st.Mute || st.Source != "D2" {
+		t.Errorf("State after padded replies = %+v, want muted on D2", st)
+	}
+	if got := a.metrics.parseErrors.Load(); got != 0 {
+		t.Errorf("Parse errors = %d, want 0", got)
+	}
+
+	// Data before the frame isn't padding, the reply may be corrupted.
+	for _, frame := range []string{"xx#02,01,1", "1#04,01,05", "#0#02,03,1"} {
+		if r, err := parseReply(frame); err == nil {
+			t.Errorf("parseReply(%q) = %+v, want an invalid reply", frame, r)
+		}
+	}
+}
+
+func TestKeepStateOnOff(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		a := NewAmplifierWithPort(newFakePort())
+		a.keepStateOnOff = keep
+		a.UpdateState(&Reply{Group: "02", Number: "01", Data: "1"})
+		a.UpdateState(&Reply{Group: "02", Number: "03", Data: "1"})
+		a.UpdateState(&Reply{Group: "04", Number: "01", Data: "05"})
+
+		a.UpdateState(&Reply{Group: "02", Number: "01", Data: "0"})
+		st := a.State()
+		if st.Power {
+			t.Errorf("Keep %v: powered on after the standby", keep)
+		}
+		if keep && (!st.Mute || st.Source != "D2") {
+			t.Errorf("Keep %v: state %+v, want the last known muted on D2", keep, st)
+		}
+		if !keep && (st.Mute || st.Source != "") {
+			t.Errorf("Keep %v: state %+v, want the mute and source cleared", keep, st)
+		}
+	}
+}
+
+func TestProtectionState(t *testing.T) {
+	logs := captureLog(t)
+	a, port := newTestAmp(t)
+	srv := serve(t, a)
+
+	port.push("#02,36,0", "#02,37,52")
+	waitFor(t, "the temperature", func() bool { return a.State().Temperature != nil })
+	if st := a.State(); st.Protection != "None" || *st.Temperature != 52 {
+		t.Errorf("State = %+v, want no protection at 52°C", st)
+	}
+	port.push("#02,36,1", "#02,37,x")
+	waitFor(t, "the protection", func() bool { return a.State().Protection == "Overtemperature" })
+	if st := a.State(); *st.Temperature != 52 {
+		t.Errorf("Temperature after an invalid reply = %d, want 52", *st.Temperature)
+	}
+	if !strings.Contains(logs.String(), "protection engaged: Overtemperature") {
+		t.Errorf("Log %q, want the protection engaged", logs)
+	}
+
+	_, body := request(t, srv, "GET", "/status", "")
+	if !strings.Contains(body, `"protection":"Overtemperature"`) || !strings.Contains(body, `"temperature":52`) {
+		t.Errorf("GET /status = %s, want the protection and temperature", body)
+	}
+	_, body = request(t, srv, "GET", "/metrics", "")
+	if !strings.Contains(body, `cxa81_protection{status="Overtemperature"} 1`) || !strings.Contains(body, "cxa81_temperature_celsius 52") {
+		t.Errorf("GET /metrics = %s, want the protection and temperature", body)
+	}
+
+	for _, tt := range []struct {
+		reply Reply
+		want  string
+	}{
+		{Reply{Group: "02", Number: "36", Data: "3"}, "Protection: Short circuit"},
+		{Reply{Group: "02", Number: "37", Data: "52"}, "Temperature: 52°C"},
+	} {
+		if got := tt.reply.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestDebugBytes(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		logs := captureLog(t)
+		a := NewAmplifierWithPort(newFakePort())
+		a.debug = debug
+		if err := a.SendCommand(SetMuteOn); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.readUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		out := logs.String()
+		for _, line := range []string{`Debug: command to amp "#01,04,1\r"`, `Debug: response from amp "#02,03,1\r"`} {
+			if strings.Contains(out, line) != debug {
+				t.Errorf("Debug %v: log %q, want %s logged %v", debug, out, line, debug)
+			}
+		}
+	}
+}
+
+func TestServeSourceA1(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, tt := range []struct {
+		query  string
+		cmd    Command
+		source string
+	}{
+		{"?balanced=true", SetSourceA1Balanced, "A1 Balanced"},
+		{"?balanced=false", SetSourceA1, "A1"},
+		{"?balanced=1", SetSourceA1Balanced, "A1 Balanced"},
+		{"", SetSourceA1, "A1"},
+	} {
+		port.reset()
+		resp, body := request(t, srv, "POST", "/source/a1"+tt.query, "")
+		if resp.StatusCode != 200 || !strings.Contains(body, `"source":"`+tt.source+`"`) {
+			t.Errorf("POST /source/a1%s = %d %s, want %s", tt.query, resp.StatusCode, body, tt.source)
+		}
+		if got := port.commands(); !slices.Equal(got, []Command{tt.cmd}) {
+			t.Errorf("POST /source/a1%s sent %v, want %v", tt.query, got, tt.cmd)
+		}
+	}
+	if resp, body := request(t, srv, "POST", "/source/a1?balanced=maybe", ""); resp.StatusCode != 400 {
+		t.Errorf("POST /source/a1?balanced=maybe = %d %s, want 400", resp.StatusCode, body)
+	}
+
+	// The CXA61 has no balanced input.
+	a, port = newQueriedAmp(t, func(a *Amplifier) { a.model = CXA61 })
+	srv = serve(t, a)
+	if resp, body := request(t, srv, "POST", "/source/a1?balanced=true", ""); resp.StatusCode != 400 || !strings.Contains(body, "isn't available on the CXA61") {
+		t.Errorf("POST balanced A1 on the CXA61 = %d %s, want 400", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v on the CXA61, want nothing", got)
+	}
+}
+
+func TestTransientMute(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	a, port := newQueriedAmp(t, func(a *Amplifier) { a.clock = clock })
+	events, cancel := a.Subscribe()
+	defer cancel()
+	// settle waits for the pushed replies to be handled.
+	settle := func() {
+		t.Helper()
+		if err := a.sendAndConfirm(context.Background(), GetPowerState); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The amplifier switched sources from its front panel, muting briefly.
+	port.push("#04,01,05", "#02,03,1")
+	settle()
+	if st := a.State(); st.Mute || st.Source != "D2" {
+		t.Errorf("State after the switch = %+v, want unmuted on D2", st)
+	}
+	for len(events) > 0 {
+		if e := <-events; slices.Contains(e.Fields, "mute") {
+			t.Errorf("Event %+v, want no mute change", e)
+		}
+	}
+
+	// The mute is queried again once the switch is over.
+	port.reset()
+	clock.Advance(transientMuteWindow)
+	waitFor(t, "the mute query", func() bool { return slices.Contains(port.commands(), GetMuteState) })
+	settle()
+	if a.State().Mute {
+		t.Error("Muted after the switch")
+	}
+
+	// Mutes outside the window, or requested, aren't transient.
+	port.push("#02,03,1")
+	settle()
+	if !a.State().Mute {
+		t.Error("Not muted by a mute after the window")
+	}
+	port.push("#02,03,0", "#04,01,04")
+	settle()
+	if err := a.handleMute(context.Background(), "on"); err != nil {
+		t.Fatal(err)
+	}
+	if !a.State().Mute {
+		t.Error("Not muted by a requested mute within the window")
+	}
+}
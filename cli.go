@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// controlHandler returns the handler for the given control, shared by the
+// HTTP and CLI paths so both accept the same values.
+func (a *Amplifier) controlHandler(control string) (func(context.Context, string) error, error) {
+	switch control {
+	case "power":
+		return a.handlePower, nil
+	case "mute":
+		return a.handleMute, nil
+	case "source":
+		return a.handleSource, nil
+	case "speakers":
+		return a.handleSpeakers, nil
+	}
+
+	return nil, fmt.Errorf("Unknown control: %s, expected: power/mute/source/speakers", control)
+}
+
+// parseCmd splits a -cmd value of the form control:value.
+func parseCmd(s string) (control, value string, err error) {
+	control, value, ok := strings.Cut(s, ":")
+	if !ok || control == "" || value == "" {
+		return "", "", fmt.Errorf("Invalid command %q, expected: control:value", s)
+	}
+
+	return strings.ToLower(control), value, nil
+}
+
+// runCommand applies a single -cmd value and writes the resulting state as
+// JSON to w. The command is sent at once, toggles see the state queried on
+// startup and the handler waits for its reply, then it waits for the replies
+// following it, e.g. the state queried on power on, before reporting.
+func (a *Amplifier) runCommand(s string, wait time.Duration, w io.Writer) error {
+	control, value, err := parseCmd(s)
+	if err != nil {
+		return err
+	}
+	handle, err := a.controlHandler(control)
+	if err != nil {
+		return err
+	}
+
+	if err := handle(context.Background(), value); err != nil {
+		return err
+	}
+
+	time.Sleep(wait)
+
+	return json.NewEncoder(w).Encode(a.State())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseCmd(t *testing.T) {
+	tests := []struct {
+		in             string
+		control, value string
+		ok             bool
+	}{
+		{"power:on", "power", "on", true},
+		{"Source:D2", "source", "D2", true},
+		{"mute:toggle", "mute", "toggle", true},
+		{"power", "", "", false},
+		{":on", "", "", false},
+		{"power:", "", "", false},
+	}
+	for _, tt := range tests {
+		control, value, err := parseCmd(tt.in)
+		if (err == nil) != tt.ok || control != tt.control || value != tt.value {
+			t.Errorf("parseCmd(%q) = %q, %q, %v, want %q, %q, ok %v", tt.in, control, value, err, tt.control, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	a, port := newQueriedAmp(t)
+
+	var out bytes.Buffer
+	if err := a.runCommand("source:bluetooth", 0, &out); err != nil {
+		t.Fatalf("runCommand: %v", err)
+	}
+	if got := port.commands(); len(got) != 1 || got[0] != SetSourceBluetooth {
+		t.Errorf("Sent %v, want %v", got, SetSourceBluetooth)
+	}
+	var st AmplifierState
+	if err := json.Unmarshal(out.Bytes(), &st); err != nil || st.Source != "Bluetooth" {
+		t.Errorf("Output %s, %v, want the state on Bluetooth", out.String(), err)
+	}
+
+	// The command isn't delayed by the wait for the replies following it.
+	start := time.Now()
+	if err := a.runCommand("source:D2", 100*time.Millisecond, &out); err != nil {
+		t.Fatalf("runCommand: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("runCommand took %v, want a single 100ms wait", elapsed)
+	}
+
+	if err := a.runCommand("volume:up", 0, &out); err == nil {
+		t.Error("runCommand with an unknown control succeeded")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the timer driven code, so tests can control it
+// with a FakeClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer started by Clock.AfterFunc.
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker delivers ticks every period until stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker adapts time.Ticker to Ticker.
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// FakeClock is a Clock only moving forward when advanced, firing the timers
+// which are then due.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending After, AfterFunc or ticker of a FakeClock.
+type fakeWaiter struct {
+	clock  *FakeClock
+	at     time.Time
+	period time.Duration // Tickers only
+	ch     chan time.Time
+	f      func()
+}
+
+// NewFakeClock returns a FakeClock starting at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// After returns a channel receiving the time once advanced by d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	w := &fakeWaiter{ch: make(chan time.Time, 1)}
+	c.add(w, d)
+	return w.ch
+}
+
+// AfterFunc calls f in its own goroutine once advanced by d.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	w := &fakeWaiter{f: f}
+	c.add(w, d)
+	return w
+}
+
+// NewTicker returns a ticker ticking every d of advanced time, ticks are
+// dropped when not received like with time.Ticker.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	w := &fakeWaiter{period: d, ch: make(chan time.Time, 1)}
+	c.add(w, d)
+	return fakeTicker{w}
+}
+
+// Advance moves the time forward by d, firing the due timers in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.waiters) > 0 && !c.waiters[0].at.After(end) {
+		w := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		c.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+			c.insert(w)
+		}
+		c.mu.Unlock()
+		w.fire(c.now)
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// add schedules the waiter d from now.
+func (c *FakeClock) add(w *fakeWaiter, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.clock = c
+	w.at = c.now.Add(d)
+	c.insert(w)
+}
+
+// insert adds the waiter keeping them sorted by time, c.mu must be held.
+func (c *FakeClock) insert(w *fakeWaiter) {
+	i := sort.Search(len(c.waiters), func(i int) bool { return c.waiters[i].at.After(w.at) })
+	c.waiters = append(c.waiters, nil)
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = w
+}
+
+// fire delivers the time to the waiter.
+func (w *fakeWaiter) fire(now time.Time) {
+	if w.f != nil {
+		go w.f()
+		return
+	}
+	select {
+	case w.ch <- now:
+	default:
+	}
+}
+
+// Stop cancels the waiter, reporting whether it was still pending.
+func (w *fakeWaiter) Stop() bool {
+	c := w.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTicker is a periodic fakeWaiter.
+type fakeTicker struct{ *fakeWaiter }
+
+// C returns the ticker channel.
+func (t fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop stops the ticks.
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
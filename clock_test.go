@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ticker := clock.NewTicker(time.Second)
+
+	var ticks atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range ticker.C() {
+			if ticks.Add(1) == 3 {
+				return
+			}
+		}
+	}()
+
+	clock.Advance(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if n := ticks.Load(); n != 0 {
+		t.Errorf("Ticks before the period = %d, want 0", n)
+	}
+	for i := int32(1); i <= 3; i++ {
+		clock.Advance(time.Second)
+		waitFor(t, "a tick", func() bool { return ticks.Load() == i })
+	}
+	<-done
+	ticker.Stop()
+	if n := clock.pending(); n != 0 {
+		t.Errorf("Pending after Stop = %d, want 0", n)
+	}
+	if got, want := clock.Now(), start.Add(3999*time.Millisecond); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+}
+
+func TestFakeClockTimers(t *testing.T) {
+	clock := NewFakeClock(time.Time{})
+	after := clock.After(time.Minute)
+	var fired atomic.Bool
+	clock.AfterFunc(2*time.Minute, func() { fired.Store(true) })
+	stopped := clock.AfterFunc(time.Minute, func() { t.Error("Stopped timer fired") })
+	if !stopped.Stop() {
+		t.Error("Stop() = false, want true")
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-after:
+	default:
+		t.Error("After(1m) not fired after 1m")
+	}
+	if fired.Load() {
+		t.Error("AfterFunc(2m) fired after 1m")
+	}
+	clock.Advance(time.Minute)
+	waitFor(t, "AfterFunc(2m)", fired.Load)
+	if stopped.Stop() {
+		t.Error("Stop() of a stopped timer = true, want false")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configFile   = flag.String("config", "", "YAML or JSON configuration file, flags take precedence over its values")
+	strictConfig = flag.Bool("strict-config", false, "Refuse to start when the config file references sources unknown or unavailable on the model, rather than ignoring those entries")
+)
+
+// AmpConfig configures one of several amplifiers, served under /amp/<name>/.
+type AmpConfig struct {
+	Name  string `yaml:"name"`
+	Port  string `yaml:"port"`
+	Model string `yaml:"model"`
+
+	// Labels override the top level labels by source.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Config holds the server configuration, its keys mirror the flags.
+type Config struct {
+	Port   string `yaml:"port"`
+	Listen string `yaml:"listen"`
+	Model  string `yaml:"model"`
+	User   string `yaml:"user"`
+	Pwd    string `yaml:"pwd"`
+
+	OpenAttempts int           `yaml:"open-attempts"`
+	OpenInterval time.Duration `yaml:"open-interval"`
+	LogLevel     string        `yaml:"log-level"`
+	ReadTimeout  time.Duration `yaml:"read-timeout"`
+	LineEnding   string        `yaml:"line-ending"`
+	PollInterval time.Duration `yaml:"poll-interval"`
+	Jitter       float64       `yaml:"jitter"`
+	Watchdog     time.Duration `yaml:"watchdog"`
+
+	ReconnectInitial time.Duration `yaml:"reconnect-initial"`
+	ReconnectMax     time.Duration `yaml:"reconnect-max"`
+	ReconnectFactor  float64       `yaml:"reconnect-factor"`
+
+	QueryRetryDeadline time.Duration `yaml:"query-retry-deadline"`
+	ExtendedQueries    bool          `yaml:"extended-queries"`
+
+	CommandGap     time.Duration `yaml:"command-gap"`
+	DryRun         bool          `yaml:"dry-run"`
+	WriteRetries   int           `yaml:"write-retries"`
+	ConfirmTimeout time.Duration `yaml:"confirm-timeout"`
+	Standby        string        `yaml:"standby"`
+	SourceDebounce time.Duration `yaml:"source-debounce"`
+	VerifySource   bool          `yaml:"verify-source"`
+	AlwaysSend     bool          `yaml:"always-send"`
+	KeepStateOnOff bool          `yaml:"keep-state-on-off"`
+	AutoOff        time.Duration `yaml:"auto-off"`
+	SelfTest       bool          `yaml:"selftest"`
+	SelfTestFatal  bool          `yaml:"selftest-fatal"`
+	EnableRaw      bool          `yaml:"enable-raw"`
+	EnableUI       bool          `yaml:"ui"`
+
+	TLSCert       string `yaml:"tls-cert"`
+	TLSKey        string `yaml:"tls-key"`
+	TLSSelfSigned bool   `yaml:"tls-self-signed"`
+
+	CORSOrigin     string        `yaml:"cors-origin"`
+	RateLimit      float64       `yaml:"rate-limit"`
+	RateBurst      int           `yaml:"rate-burst"`
+	UserCooldown   time.Duration `yaml:"user-cooldown"`
+	IdempotencyTTL time.Duration `yaml:"idempotency-ttl"`
+	MaxBody        int64         `yaml:"max-body"`
+	JSONStyle      string        `yaml:"json-style"`
+	HealthzStale   time.Duration `yaml:"healthz-stale"`
+	HistorySize    int           `yaml:"history-size"`
+	StateFile      string        `yaml:"state-file"`
+
+	AuditLog        string `yaml:"audit-log"`
+	AuditLogMaxSize int64  `yaml:"audit-log-max-size"`
+
+	// Amps lists the amplifiers when there are several, only from the
+	// config file. Port and Model are then the defaults for the list.
+	Amps []AmpConfig `yaml:"amps"`
+
+	// Labels maps source names to the user's names for them, e.g. D1: TV,
+	// only from the config file.
+	Labels map[string]string `yaml:"labels"`
+
+	// Allow and Deny restrict the changes by category, e.g. power, or
+	// category and value, e.g. power:off or source:D1. Only from the config
+	// file.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// Macros are named sequences of changes, only from the config file.
+	Macros map[string][]MacroStep `yaml:"macros"`
+
+	StrictConfig bool `yaml:"strict-config"`
+}
+
+// configFromFlags returns the configuration from the flag values.
+func configFromFlags() *Config {
+	return &Config{
+		Port:   *port,
+		Listen: *listen,
+		Model:  *model,
+		User:   *user,
+		Pwd:    *pwd,
+
+		OpenAttempts: *openAttempts,
+		OpenInterval: *openInterval,
+		LogLevel:     *logLevel,
+		ReadTimeout:  *readTimeout,
+		LineEnding:   *lineEnding,
+		PollInterval: *pollInterval,
+		Jitter:       *jitter,
+		Watchdog:     *watchdog,
+
+		ReconnectInitial: *reconnectInitial,
+		ReconnectMax:     *reconnectMax,
+		ReconnectFactor:  *reconnectFactor,
+
+		QueryRetryDeadline: *queryRetryDeadline,
+		ExtendedQueries:    *extendedQueries,
+
+		CommandGap:     *commandGap,
+		DryRun:         *dryRun,
+		WriteRetries:   *writeRetries,
+		ConfirmTimeout: *confirmTimeout,
+		Standby:        *standbyMode,
+		SourceDebounce: *sourceDebounce,
+		VerifySource:   *verifySource,
+		AlwaysSend:     *alwaysSend,
+		KeepStateOnOff: *keepStateOnOff,
+		AutoOff:        *autoOff,
+		SelfTest:       *selfTest,
+		SelfTestFatal:  *selfTestFatal,
+		EnableRaw:      *enableRaw,
+		EnableUI:       *enableUI,
+
+		TLSCert:       *tlsCert,
+		TLSKey:        *tlsKey,
+		TLSSelfSigned: *tlsSelfSigned,
+
+		CORSOrigin:     *corsOrigin,
+		RateLimit:      *rateLimit,
+		RateBurst:      *rateBurst,
+		UserCooldown:   *userCooldown,
+		IdempotencyTTL: *idempotencyTTL,
+		MaxBody:        *maxBody,
+		JSONStyle:      *jsonStyle,
+		HealthzStale:   *healthStale,
+		HistorySize:    *historySize,
+		StateFile:      *stateFile,
+
+		AuditLog:        *auditLogFile,
+		AuditLogMaxSize: *auditLogMaxSize,
+
+		StrictConfig: *strictConfig,
+	}
+}
+
+// loadConfig returns the configuration from the given file, or only from the
+// flags if path is empty. Flags set on the command line override the file.
+func loadConfig(path string) (*Config, error) {
+	flags := configFromFlags()
+	if path == "" {
+		return flags, flags.Validate()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// JSON is valid YAML, so a single decoder handles both formats.
+	cfg := configFromFlags()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+
+	// Restore the values of the flags set on the command line.
+	dst, src := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(flags).Elem()
+	flag.Visit(func(f *flag.Flag) {
+		for i := 0; i < dst.NumField(); i++ {
+			if dst.Type().Field(i).Tag.Get("yaml") == f.Name {
+				dst.Field(i).Set(src.Field(i))
+			}
+		}
+	})
+
+	if err := cfg.checkSources(); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// checkSources finds the labels, macros and rules referencing sources which
+// are unknown or unavailable on all the configured models. With strict-config
+// they are an error listing them, otherwise they are logged and dropped.
+func (c *Config) checkSources() error {
+	var models []string
+	for _, ac := range c.amplifiers() {
+		model := cmp.Or(ac.Model, c.Model)
+		if !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	}
+	usable := func(models []string, src Source) bool {
+		return slices.ContainsFunc(models, src.availableOn)
+	}
+
+	var offending []string
+	checkLabels := func(labels map[string]string, models []string, where string) {
+		for _, s := range slices.Sorted(maps.Keys(labels)) {
+			if src, ok := lookupSource(s); !ok || !usable(models, src) {
+				offending = append(offending, fmt.Sprintf("label for source %q%s", s, where))
+				if !c.StrictConfig {
+					delete(labels, s)
+				}
+			}
+		}
+	}
+	checkLabels(c.Labels, models, "")
+	for _, ac := range c.Amps {
+		checkLabels(ac.Labels, []string{cmp.Or(ac.Model, c.Model)}, " of amplifier "+ac.Name)
+	}
+
+	// Macro sources may be labels, invalid ones are reported by Validate.
+	a := &Amplifier{labels: make(map[string]string)}
+	for s, label := range c.Labels {
+		if src, ok := lookupSource(s); ok {
+			a.labels[src.Name] = strings.TrimSpace(label)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Macros)) {
+		for i, step := range c.Macros[name] {
+			if step.Source == "" {
+				continue
+			}
+			if src, ok := a.findSource(step.Source); !ok || !usable(models, src) {
+				offending = append(offending, fmt.Sprintf("macro %s step %d source %q", name, i+1, step.Source))
+				if !c.StrictConfig {
+					delete(c.Macros, name)
+				}
+				break
+			}
+		}
+	}
+
+	checkRules := func(rules []string, kind string) []string {
+		return slices.DeleteFunc(rules, func(rule string) bool {
+			category, value, ok := strings.Cut(strings.ToLower(strings.TrimSpace(rule)), ":")
+			if !ok || category != "source" {
+				return false
+			}
+			if src, ok := lookupSource(value); ok && usable(models, src) {
+				return false
+			}
+			offending = append(offending, fmt.Sprintf("%s rule %q", kind, rule))
+			return !c.StrictConfig
+		})
+	}
+	c.Allow = checkRules(c.Allow, "allow")
+	c.Deny = checkRules(c.Deny, "deny")
+
+	if len(offending) == 0 {
+		return nil
+	}
+	if c.StrictConfig {
+		return fmt.Errorf("Sources unknown or unavailable on the %s in: %s", strings.Join(models, "/"), strings.Join(offending, ", "))
+	}
+	for _, o := range offending {
+		log.Printf("warning, ignoring the %s, unknown or unavailable on the %s", o, strings.Join(models, "/"))
+	}
+	return nil
+}
+
+// Validate checks the configuration is usable.
+func (c *Config) Validate() error {
+	if c.Port == "" {
+		return errors.New("port is required")
+	}
+	if err := validateListenAddr(c.Listen); err != nil {
+		return err
+	}
+	if c.Model != CXA61 && c.Model != CXA81 {
+		return fmt.Errorf("Invalid model %q, expected: %s/%s", c.Model, CXA61, CXA81)
+	}
+	if c.Standby != "reject" && c.Standby != "wake" {
+		return fmt.Errorf("Invalid standby %q, expected: reject/wake", c.Standby)
+	}
+	if c.LogLevel != "info" && c.LogLevel != "debug" {
+		return fmt.Errorf("Invalid log-level %q, expected: info/debug", c.LogLevel)
+	}
+	if _, ok := lineEndings[c.LineEnding]; !ok {
+		return fmt.Errorf("Invalid line-ending %q, expected: cr/lf/crlf", c.LineEnding)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("Both tls-cert and tls-key must be set")
+	}
+	names := make(map[string]bool)
+	for _, ac := range c.Amps {
+		if ac.Name == "" || strings.Contains(ac.Name, "/") {
+			return fmt.Errorf("Invalid amplifier name %q", ac.Name)
+		}
+		if names[ac.Name] {
+			return fmt.Errorf("Duplicate amplifier name %q", ac.Name)
+		}
+		names[ac.Name] = true
+		if ac.Model != "" && ac.Model != CXA61 && ac.Model != CXA81 {
+			return fmt.Errorf("Invalid model %q for amplifier %s, expected: %s/%s", ac.Model, ac.Name, CXA61, CXA81)
+		}
+	}
+	if _, err := parseLabels(c.Labels); err != nil {
+		return err
+	}
+	if _, err := parseRules(c.Allow, c.Deny); err != nil {
+		return err
+	}
+	for _, ac := range c.amplifiers() {
+		// Also checks the amplifier labels.
+		cfg := c.forAmplifier(ac)
+		if err := validateMacros(cfg.Macros, cfg.Model, cfg.Labels); err != nil {
+			if ac.Name != "" {
+				return fmt.Errorf("%v for amplifier %s", err, ac.Name)
+			}
+			return err
+		}
+	}
+	if c.OpenAttempts < 1 {
+		return fmt.Errorf("Invalid open-attempts %d, expected at least 1", c.OpenAttempts)
+	}
+	if c.WriteRetries < 0 {
+		return fmt.Errorf("Invalid write-retries %d, expected a positive number", c.WriteRetries)
+	}
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return fmt.Errorf("Invalid jitter %v, expected a fraction from 0 to 1", c.Jitter)
+	}
+	if c.ReconnectInitial <= 0 || c.ReconnectMax < c.ReconnectInitial {
+		return fmt.Errorf("Invalid reconnect-initial %v or reconnect-max %v, expected 0 < initial <= max", c.ReconnectInitial, c.ReconnectMax)
+	}
+	if c.ReconnectFactor < 1 {
+		return fmt.Errorf("Invalid reconnect-factor %v, expected at least 1", c.ReconnectFactor)
+	}
+	if c.QueryRetryDeadline < 0 {
+		return fmt.Errorf("Invalid query-retry-deadline %v, expected a positive duration", c.QueryRetryDeadline)
+	}
+	if c.Watchdog < 0 {
+		return fmt.Errorf("Invalid watchdog %v, expected a positive duration", c.Watchdog)
+	}
+	if c.AuditLogMaxSize < 0 {
+		return fmt.Errorf("Invalid audit-log-max-size %d, expected a positive number", c.AuditLogMaxSize)
+	}
+	if c.HistorySize < 0 {
+		return fmt.Errorf("Invalid history-size %d, expected a positive number", c.HistorySize)
+	}
+	if c.User == "" && c.Pwd != "" {
+		return errors.New("pwd is set without user")
+	}
+	if c.JSONStyle != jsonCamel && c.JSONStyle != jsonSnake {
+		return fmt.Errorf("Invalid json-style %q, expected: %s/%s", c.JSONStyle, jsonCamel, jsonSnake)
+	}
+	if c.MaxBody < 1 {
+		return fmt.Errorf("Invalid max-body %d, expected at least 1", c.MaxBody)
+	}
+	if c.UserCooldown < 0 {
+		return fmt.Errorf("Invalid user-cooldown %v, expected a positive duration", c.UserCooldown)
+	}
+	if c.IdempotencyTTL < 0 {
+		return fmt.Errorf("Invalid idempotency-ttl %v, expected a positive duration", c.IdempotencyTTL)
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return errors.New("Invalid rate-limit or rate-burst, expected positive numbers")
+	}
+
+	return nil
+}
+
+// amplifiers returns the configured amplifiers, a single unnamed one when the
+// amps list is empty.
+func (c *Config) amplifiers() []AmpConfig {
+	if len(c.Amps) == 0 {
+		return []AmpConfig{{Port: c.Port, Model: c.Model}}
+	}
+	return c.Amps
+}
+
+// forAmplifier returns the configuration for the given amplifier.
+func (c *Config) forAmplifier(ac AmpConfig) *Config {
+	cfg := *c
+	cfg.StateFile = stateFileFor(c.StateFile, ac.Name)
+	if ac.Port != "" {
+		cfg.Port = ac.Port
+	}
+	if ac.Model != "" {
+		cfg.Model = ac.Model
+	}
+	if len(ac.Labels) > 0 {
+		cfg.Labels = make(map[string]string, len(c.Labels)+len(ac.Labels))
+		for _, labels := range []map[string]string{c.Labels, ac.Labels} {
+			for s, label := range labels {
+				// Key by source name so the amplifier labels
+				// replace the top level ones whatever the case.
+				if src, ok := lookupSource(s); ok {
+					s = src.Name
+				}
+				cfg.Labels[s] = label
+			}
+		}
+	}
+	return &cfg
+}
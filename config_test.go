@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the configuration file contents to a temporary file,
+// returning its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, contents := range map[string]string{
+		"config.yaml": "port: /dev/ttyUSB1\nmodel: CXA61\npoll-interval: 5s\nlabels:\n  D1: TV\n",
+		"config.json": `{"port": "/dev/ttyUSB1", "model": "CXA61", "poll-interval": "5s", "labels": {"D1": "TV"}}`,
+	} {
+		cfg, err := loadConfig(writeConfig(t, name, contents))
+		if err != nil {
+			t.Errorf("loadConfig(%s): %v", name, err)
+			continue
+		}
+		if cfg.Port != "/dev/ttyUSB1" || cfg.Model != CXA61 || cfg.PollInterval != 5*time.Second || cfg.Labels["D1"] != "TV" {
+			t.Errorf("loadConfig(%s) = %+v", name, cfg)
+		}
+		// Keys missing from the file keep the flag defaults.
+		if cfg.Listen != ":8080" || cfg.CommandGap != 50*time.Millisecond {
+			t.Errorf("loadConfig(%s) defaults: listen %q, command gap %v", name, cfg.Listen, cfg.CommandGap)
+		}
+	}
+}
+
+func TestLoadConfigFlagPrecedence(t *testing.T) {
+	if err := flag.Set("listen", "127.0.0.1:9999"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("listen", ":8080") })
+
+	cfg, err := loadConfig(writeConfig(t, "config.yaml", "listen: ':7000'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "127.0.0.1:9999" {
+		t.Errorf("Listen = %q, want the flag value", cfg.Listen)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		contents string
+		want     string
+	}{
+		{"prot: /dev/ttyUSB0\n", "field prot not found"},
+		{"model: CXA60\n", "Invalid model"},
+		{"tls-cert: cert.pem\n", "tls-cert and tls-key"},
+		{"jitter: 1.5\n", "Invalid jitter"},
+		{"amps:\n  - name: a\n  - name: a\n", "Duplicate amplifier name"},
+		{"port: [\n", "Invalid config file"},
+		{"model: CXA61\nstrict-config: true\nlabels:\n  USB: Laptop\n", "unavailable on the CXA61 in: label for source \"USB\""},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(writeConfig(t, "config.yaml", tt.contents))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig(%q) = %v, want %q", tt.contents, err, tt.want)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loadConfig of a missing file succeeded")
+	}
+}
+
+func TestCheckSources(t *testing.T) {
+	// config returns a CXA61 config referencing the CXA81 only USB input.
+	config := func(strict bool) *Config {
+		return &Config{
+			Model:        CXA61,
+			StrictConfig: strict,
+			Labels:       map[string]string{"D1": "TV", "USB": "Laptop", "Z9": "Nope"},
+			Macros: map[string][]MacroStep{
+				"tv":     {{Source: "TV"}, {Mute: "off"}},
+				"laptop": {{Power: "on"}, {Source: "USB"}},
+			},
+			Allow: []string{"source:d1", "source:usb", "mute"},
+			Deny:  []string{"power:off"},
+		}
+	}
+
+	err := config(true).checkSources()
+	for _, want := range []string{
+		"Sources unknown or unavailable on the CXA61",
+		`label for source "USB"`, `label for source "Z9"`,
+		`macro laptop step 2 source "USB"`, `allow rule "source:usb"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Strict checkSources() = %v, want %s", err, want)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "macro tv") {
+		t.Errorf("Strict checkSources() = %v, the tv macro source is a label", err)
+	}
+
+	logs := captureLog(t)
+	cfg := config(false)
+	if err := cfg.checkSources(); err != nil {
+		t.Fatalf("Lenient checkSources() = %v, want nil", err)
+	}
+	if want := map[string]string{"D1": "TV"}; !maps.Equal(cfg.Labels, want) {
+		t.Errorf("Labels = %v, want %v", cfg.Labels, want)
+	}
+	if _, ok := cfg.Macros["laptop"]; ok || len(cfg.Macros) != 1 {
+		t.Errorf("Macros = %v, want only tv", cfg.Macros)
+	}
+	if want := []string{"source:d1", "mute"}; !slices.Equal(cfg.Allow, want) {
+		t.Errorf("Allow = %v, want %v", cfg.Allow, want)
+	}
+	if out := logs.String(); strings.Count(out, "warning, ignoring the") != 4 {
+		t.Errorf("Log %q, want a warning per dropped entry", out)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Serial connection statuses
+const (
+	connConnected    = "connected"
+	connReconnecting = "reconnecting"
+	connError        = "error"
+)
+
+// Default reconnection backoff, the delay doubles from 1s up to 30s.
+const (
+	defaultReconnectInitial = time.Second
+	defaultReconnectMax     = 30 * time.Second
+	defaultReconnectFactor  = 2.0
+)
+
+// serialMode is the CXA serial line configuration.
+var serialMode = &serial.Mode{
+	BaudRate: 9600,
+	Parity:   serial.NoParity,
+	DataBits: 8,
+	StopBits: serial.OneStopBit,
+}
+
+// lineEndings maps the line-ending values to the terminator of the commands
+// and replies.
+var lineEndings = map[string]string{
+	"cr":   "\r",
+	"lf":   "\n",
+	"crlf": "\r\n",
+}
+
+// openSerial opens the serial port, or connects to the serial bridge for a
+// tcp:// port, retrying while it doesn't exist.
+func (a *Amplifier) openSerial(attempts int, interval time.Duration) (io.ReadWriteCloser, error) {
+	if strings.HasPrefix(a.portName, tcpPrefix) {
+		return dialTCP(a.portName, a.readTimeout, attempts, interval)
+	}
+
+	port, err := openPortRetry(a.portName, serialMode, attempts, interval)
+	if err != nil {
+		return nil, err
+	}
+	if a.readTimeout > 0 {
+		if err := port.SetReadTimeout(a.readTimeout); err != nil {
+			port.Close()
+			return nil, err
+		}
+	}
+
+	return port, nil
+}
+
+// setConnection updates the connection status, err is kept as the last error
+// if not nil.
+func (a *Amplifier) setConnection(status string, err error) {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+
+	changed := status != a.connStatus
+	a.connStatus = status
+	if err != nil {
+		a.connErr = err.Error()
+	}
+	if changed {
+		log.Printf("Serial connection: %s", status)
+		e := Event{Type: eventConnection, Connection: status}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		// Published under connMu so the events are in order.
+		a.publish(e)
+	}
+}
+
+// connection returns the connection status and the last error.
+func (a *Amplifier) connection() (status, lastErr string) {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+
+	return a.connStatus, a.connErr
+}
+
+// nextReconnectDelay returns the delay after delay, grown by reconnectFactor
+// up to reconnectMax.
+func (a *Amplifier) nextReconnectDelay(delay time.Duration) time.Duration {
+	next := time.Duration(float64(delay) * a.reconnectFactor)
+	if next < delay { // Overflow
+		return a.reconnectMax
+	}
+	return min(next, a.reconnectMax)
+}
+
+// reconnectWait bounds how long POST /admin/reconnect waits for the port to
+// be reopened.
+const reconnectWait = 30 * time.Second
+
+// serveReconnect closes the serial port so that the Listen loop, the only one
+// opening it, reopens it and queries the state again. It replies with the
+// state once that's done.
+func (a *Amplifier) serveReconnect(w http.ResponseWriter, r *http.Request) {
+	if a.portName == "" {
+		writeError(w, "The serial port can't be reopened", http.StatusConflict)
+		return
+	}
+
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	log.Printf("Reconnect requested, closing %s", a.portName)
+	a.closePort()
+
+	timeout := a.clock.After(reconnectWait)
+	for connected := false; !connected; {
+		select {
+		case e := <-events:
+			connected = e.Type == eventConnection && e.Connection == connConnected
+		case <-timeout:
+			writeError(w, fmt.Sprintf("Serial port %s not reopened after %v", a.portName, reconnectWait), http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Waits for the queries started on reconnecting.
+	a.writeRefreshed(w, a.Refresh(r.Context()))
+}
+
+// reconnect closes the port after a read error and opens it again, with an
+// exponential backoff, until it succeeds or ctx is done. The state is then
+// queried again as changes may have been missed.
+func (a *Amplifier) reconnect(ctx context.Context, cause error) {
+	if a.portName == "" {
+		// The port wasn't opened by name, so it can't be reopened.
+		a.setConnection(connError, cause)
+		a.sleepContext(ctx, jittered(a.reconnectInitial, a.jitter))
+		return
+	}
+
+	a.setConnection(connReconnecting, cause)
+	a.closePort()
+	a.partial = nil
+
+	delay := a.reconnectInitial
+	for ctx.Err() == nil {
+		port, err := a.openSerial(1, 0)
+		if err == nil {
+			a.portMu.Lock()
+			a.port = port
+			a.portMu.Unlock()
+			a.metrics.reconnections.Add(1)
+			a.setConnection(connConnected, nil)
+
+			go func() {
+				if err := a.Refresh(context.Background()); err != nil {
+					log.Printf("error, querying state after reconnecting: %v", err)
+				}
+			}()
+			return
+		}
+
+		a.setConnection(connReconnecting, err)
+		wait := jittered(delay, a.jitter)
+		log.Printf("error, reconnecting to %s: %v, retrying in %v", a.portName, err, wait.Round(time.Millisecond))
+		a.sleepContext(ctx, wait)
+		delay = a.nextReconnectDelay(delay)
+	}
+}
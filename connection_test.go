@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+func TestNextReconnectDelay(t *testing.T) {
+	for _, tt := range []struct {
+		initial, max time.Duration
+		factor       float64
+		want         []time.Duration
+	}{
+		{defaultReconnectInitial, defaultReconnectMax, defaultReconnectFactor, []time.Duration{
+			time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second,
+		}},
+		{500 * time.Millisecond, 2 * time.Second, 1.5, []time.Duration{
+			500 * time.Millisecond, 750 * time.Millisecond, 1125 * time.Millisecond, 1687500 * time.Microsecond, 2 * time.Second,
+		}},
+		{5 * time.Second, time.Minute, 1, []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}},
+	} {
+		a := NewAmplifierWithPort(newFakePort())
+		a.reconnectMax, a.reconnectFactor = tt.max, tt.factor
+
+		got := []time.Duration{tt.initial}
+		for len(got) < len(tt.want) {
+			got = append(got, a.nextReconnectDelay(got[len(got)-1]))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Delays from %v up to %v by %v = %v, want %v", tt.initial, tt.max, tt.factor, got, tt.want)
+		}
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	var mu sync.Mutex
+	var ports []*fakePort
+	opens := 0
+	stubOpenPort(t, func(name string, mode *serial.Mode) (serial.Port, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opens++
+		if opens == 2 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		port := newFakePort()
+		ports = append(ports, port)
+		return fakeSerial{port}, nil
+	})
+	a, err := NewAmplifier(testConfig("/dev/ttyUSB0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start(context.Background())
+	t.Cleanup(func() { a.Close() })
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	ports[0].Close()
+
+	// next returns the next connection event.
+	next := func() Event {
+		t.Helper()
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == eventConnection {
+					return e
+				}
+			case <-timeout:
+				t.Fatal("Timed out waiting for a connection event")
+			}
+		}
+	}
+	if e := next(); e.Connection != connReconnecting || !strings.Contains(e.Error, os.ErrClosed.Error()) {
+		t.Errorf("First event = %+v, want reconnecting with the read error", e)
+	}
+	if e := next(); e.Connection != connConnected || e.Error != "" {
+		t.Errorf("Second event = %+v, want connected", e)
+	}
+
+	// Ports which can't be reopened end in error.
+	b, port := newTestAmp(t)
+	events, cancel = b.Subscribe()
+	defer cancel()
+	port.Close()
+	if e := next(); e.Connection != connError || !strings.Contains(e.Error, os.ErrClosed.Error()) {
+		t.Errorf("Event = %+v, want error with the read error", e)
+	}
+}
+
+func TestServeReconnect(t *testing.T) {
+	var mu sync.Mutex
+	var ports []*fakePort
+	stubOpenPort(t, func(name string, mode *serial.Mode) (serial.Port, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		port := newFakePort()
+		if len(ports) > 0 {
+			// The source changed while disconnected.
+			port.set(GetSource, "14")
+		}
+		ports = append(ports, port)
+		return fakeSerial{port}, nil
+	})
+	a, err := NewAmplifier(testConfig("/dev/ttyUSB0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start(context.Background())
+	t.Cleanup(func() { a.Close() })
+	if _, err := a.QueryAll(context.Background()); err != nil {
+		t.Fatalf("QueryAll: %v", err)
+	}
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/admin/reconnect", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"source":"Bluetooth"`) {
+		t.Errorf("POST /admin/reconnect = %d %s, want the state queried again", resp.StatusCode, body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 2 {
+		t.Fatalf("Opened %d ports, want 2", len(ports))
+	}
+	select {
+	case <-ports[0].closed:
+	default:
+		t.Error("First port not closed")
+	}
+	if sent := ports[1].commands(); !slices.Contains(sent, GetSource) || !slices.Contains(sent, GetPowerState) {
+		t.Errorf("Sent on the reopened port %v, want the state queries", sent)
+	}
+	if got := a.State().Source; got != "Bluetooth" {
+		t.Errorf("Source = %q, want Bluetooth", got)
+	}
+
+	// Ports which weren't opened by name can't be reopened.
+	b, _ := newTestAmp(t)
+	if resp, _ := request(t, serve(t, b), "POST", "/admin/reconnect", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("POST /admin/reconnect without a port name = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
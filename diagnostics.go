@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// diagnostics is the /diagnostics reply, collecting the status, versions and
+// counters for support requests.
+type diagnostics struct {
+	Version         string `json:"version"`
+	GoVersion       string `json:"goVersion"`
+	Model           string `json:"model"`
+	ProtocolVersion string `json:"protocolVersion"`
+	FirmwareVersion string `json:"firmwareVersion"`
+
+	Connection string `json:"connection"`
+	LastError  string `json:"lastError,omitempty"`
+	LastReply  string `json:"lastReply,omitempty"`
+
+	Reconnections uint64 `json:"reconnections"`
+	ParseErrors   uint64 `json:"parseErrors"`
+
+	// CommandsSent and CommandTimeouts are by command group.
+	CommandsSent    map[string]uint64 `json:"commandsSent"`
+	CommandTimeouts map[string]uint64 `json:"commandTimeouts"`
+
+	State AmplifierState `json:"state"`
+}
+
+// serveDiagnostics serves the diagnostics.
+func (a *Amplifier) serveDiagnostics(w http.ResponseWriter, r *http.Request) {
+	state := a.State()
+	status, lastErr := a.connection()
+	sent, timeouts := a.metrics.counts()
+
+	d := diagnostics{
+		Version:         version,
+		GoVersion:       runtime.Version(),
+		Model:           a.model,
+		ProtocolVersion: state.ProtocolVersion,
+		FirmwareVersion: state.FirmwareVersion,
+		Connection:      status,
+		LastError:       lastErr,
+		Reconnections:   a.metrics.reconnections.Load(),
+		ParseErrors:     a.metrics.parseErrors.Load(),
+		CommandsSent:    sent,
+		CommandTimeouts: timeouts,
+		State:           state,
+	}
+	if ns := a.lastReplyTime.Load(); ns != 0 {
+		d.LastReply = time.Unix(0, ns).Format(time.RFC3339)
+	}
+	// Encode no counts as empty objects rather than null.
+	if d.CommandsSent == nil {
+		d.CommandsSent = map[string]uint64{}
+	}
+	if d.CommandTimeouts == nil {
+		d.CommandTimeouts = map[string]uint64{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestServeDiagnostics(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "GET", "/diagnostics", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /diagnostics = %d %s", resp.StatusCode, body)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"version", "goVersion", "model", "protocolVersion", "firmwareVersion",
+		"connection", "lastReply", "reconnections", "parseErrors",
+		"commandsSent", "commandTimeouts", "state",
+	}
+	if got := slices.Sorted(maps.Keys(doc)); !slices.Equal(got, slices.Sorted(slices.Values(want))) {
+		t.Errorf("GET /diagnostics keys = %v, want %v", got, want)
+	}
+
+	var d diagnostics
+	if err := json.Unmarshal([]byte(body), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Connection != connConnected || d.FirmwareVersion != "2.1" || d.CommandsSent["01"] == 0 || d.CommandTimeouts == nil || !d.State.Power {
+		t.Errorf("GET /diagnostics = %s, want connected with the versions, counts and state", body)
+	}
+}
+
+func TestDiagnosticsAuth(t *testing.T) {
+	a, _ := newTestAmp(t)
+	srv := httptest.NewServer(withBasicAuth("admin", "secret", a.routes(false, false)))
+	defer srv.Close()
+
+	if resp, _ := request(t, srv, "GET", "/diagnostics", ""); resp.StatusCode != 401 {
+		t.Errorf("GET /diagnostics without credentials = %d, want 401", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/diagnostics", nil)
+	req.SetBasicAuth("admin", "secret")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("GET /diagnostics with credentials = %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+// brightnessSetting is the display brightness, served by serveLevel.
+var brightnessSetting = levelSetting{
+	name:  "Display brightness",
+	field: "brightness",
+	rule:  "display",
+	get:   GetDisplayBrightness,
+	set:   SetDisplayBrightness,
+	level: func(st AmplifierState) *int { return st.DisplayBrightness },
+	known: "displayBrightness",
+}
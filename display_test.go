@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDisplayBrightness(t *testing.T) {
+	for level := minBrightness; level <= maxBrightness; level++ {
+		c, err := SetDisplayBrightness(level)
+		if want := (Command{Group: "01", Number: "29", Data: strconv.Itoa(level)}); err != nil || c != want {
+			t.Errorf("SetDisplayBrightness(%d) = %v, %v, want %v", level, c, err, want)
+		}
+	}
+	for _, level := range []int{minBrightness - 1, maxBrightness + 1} {
+		if _, err := SetDisplayBrightness(level); err == nil {
+			t.Errorf("SetDisplayBrightness(%d) = nil error, want out of range", level)
+		}
+	}
+
+	a := NewAmplifierWithPort(newFakePort())
+	for _, tt := range []struct {
+		data string
+		want int
+	}{{"1", 1}, {"0", 0}, {"9", 0}, {"dim", 0}} {
+		a.UpdateState(&Reply{Group: "02", Number: "28", Data: tt.data})
+		if got := a.State().DisplayBrightness; got == nil || *got != tt.want {
+			t.Errorf("Brightness after %q = %v, want %d", tt.data, got, tt.want)
+		}
+	}
+	if got, want := (&Reply{Group: "02", Number: "28", Data: "2"}).String(), "Display brightness: 2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestServeBrightness(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	if resp, body := request(t, srv, "GET", "/display/brightness", ""); resp.StatusCode != 200 || body != "{\"brightness\":2}\n" {
+		t.Errorf("GET /display/brightness = %d %s, want 2", resp.StatusCode, body)
+	}
+	resp, body := request(t, srv, "PUT", "/display/brightness", `{"brightness": 0}`)
+	if resp.StatusCode != 200 || body != "{\"brightness\":0}\n" {
+		t.Errorf("PUT /display/brightness = %d %s, want 0", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 2 || got[1] != (Command{Group: "01", Number: "29", Data: "0"}) {
+		t.Errorf("Sent %v, want the query then brightness 0", got)
+	}
+	if resp, body := request(t, srv, "PUT", "/display/brightness", `{"brightness": 3}`); resp.StatusCode != 400 {
+		t.Errorf("PUT brightness 3 = %d %s, want 400", resp.StatusCode, body)
+	}
+}
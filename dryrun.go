@@ -0,0 +1,100 @@
+package main
+
+import (
+	"maps"
+	"slices"
+)
+
+// dryRunDefaults are the data the simulated amplifier replies to the queries
+// with, by group and number, until a command changes them. The model is the
+// configured one.
+var dryRunDefaults = map[[2]string]string{
+	{"01", "01"}: "1",      // Power
+	{"01", "03"}: "0",      // Mute
+	{"01", "24"}: "0",      // Speaker output
+	{"01", "26"}: "0",      // Headphones
+	{"01", "27"}: "1",      // Speakers
+	{"01", "28"}: "2",      // Display brightness
+	{"01", "30"}: "0",      // Auto power down
+	{"01", "32"}: "30",     // Startup volume
+	{"01", "34"}: "100",    // Max volume
+	{"01", "36"}: "0",      // Protection
+	{"01", "37"}: "40",     // Temperature
+	{"03", "01"}: "04",     // Source
+	{"05", "01"}: "0",      // Bass
+	{"05", "03"}: "0",      // Treble
+	{"05", "05"}: "0",      // Balance
+	{"13", "01"}: "1.0",    // Protocol version
+	{"13", "02"}: "0.0",    // Firmware version
+	{"13", "04"}: "DRYRUN", // Serial number
+}
+
+// simulateReply processes the reply the amplifier would send to the command,
+// so that commands and queries are answered in dry run as when written.
+func (a *Amplifier) simulateReply(c Command) {
+	r := a.simulate(c)
+	a.UpdateState(r)
+	a.notifyWatchers(r)
+}
+
+// simulate returns the reply of the simulated amplifier to the command,
+// updating its state for the set commands. Like the amplifier, it rejects the
+// commands needing power in standby and those it doesn't know.
+func (a *Amplifier) simulate(c Command) *Reply {
+	a.dryRunMu.Lock()
+	defer a.dryRunMu.Unlock()
+
+	if a.dryRunState == nil {
+		a.dryRunState = maps.Clone(dryRunDefaults)
+		a.dryRunState[[2]string{GetModel.Group, GetModel.Number}] = a.model
+	}
+	state := a.dryRunState
+	reply := func(number, data string) *Reply {
+		return &Reply{Group: replyGroup(c), Number: number, Data: data}
+	}
+
+	key := [2]string{c.Group, c.Number}
+	if state[[2]string{"01", "01"}] != "1" && needsPower(c) {
+		return &Reply{Group: "00", Number: "04"}
+	}
+	switch key {
+	case [2]string{"03", "02"}, [2]string{"03", "03"}:
+		var codes []string
+		for _, s := range sourceTable {
+			if s.availableOn(a.model) {
+				codes = append(codes, s.Code)
+			}
+		}
+		i := max(slices.Index(codes, state[[2]string{"03", "01"}]), 0)
+		if c.Number == "02" {
+			i = (i + 1) % len(codes)
+		} else {
+			i = (i + len(codes) - 1) % len(codes)
+		}
+		state[[2]string{"03", "01"}] = codes[i]
+		return reply("01", codes[i])
+	case [2]string{"03", "05"}:
+		// The trims are kept by source code.
+		level, ok := state[[2]string{"trim", c.Data}]
+		if !ok {
+			level = "+0"
+		}
+		return reply("05", c.Data+level)
+	case [2]string{"03", "06"}:
+		if len(c.Data) > 2 {
+			state[[2]string{"trim", c.Data[:2]}] = c.Data[2:]
+		}
+		return reply("05", c.Data)
+	case [2]string{"03", "07"}:
+		return reply("07", "1")
+	}
+
+	if data, ok := state[key]; ok && c.Data == "" {
+		return reply(c.Number, data)
+	}
+	if number, ok := confirmingReply[key]; ok && c.Data != "" {
+		state[[2]string{c.Group, number}] = c.Data
+		return reply(number, c.Data)
+	}
+	return &Reply{Group: "00", Number: "02"}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrCommandRejected is returned when the amplifier replies to a command with
+// an error, group 00, reply.
+type ErrCommandRejected struct {
+	Command Command
+	Reply   Reply
+}
+
+func (e *ErrCommandRejected) Error() string {
+	return fmt.Sprintf("Command %s,%s rejected: %v", e.Command.Group, e.Command.Number, &e.Reply)
+}
+
+// NotAvailable reports whether the amplifier rejected the command as not
+// available in its current state, e.g. changing source in standby, rather
+// than as malformed.
+func (e *ErrCommandRejected) NotAvailable() bool {
+	return e.Reply.Number == "04"
+}
+
+// ErrReplyTimeout is returned when the amplifier doesn't confirm a command in
+// time.
+type ErrReplyTimeout struct {
+	Command Command
+	Timeout time.Duration
+}
+
+func (e *ErrReplyTimeout) Error() string {
+	return fmt.Sprintf("No confirmation from the amplifier for command %s,%s after %v", e.Command.Group, e.Command.Number, e.Timeout)
+}
+
+// ErrPortClosed is returned when a command can't be written as the port is
+// closed, e.g. while reconnecting.
+type ErrPortClosed struct {
+	Port string
+	Err  error
+}
+
+func (e *ErrPortClosed) Error() string {
+	if e.Port == "" {
+		return fmt.Sprintf("Serial port closed: %v", e.Err)
+	}
+	return fmt.Sprintf("Serial port %s closed: %v", e.Port, e.Err)
+}
+
+func (e *ErrPortClosed) Unwrap() error { return e.Err }
+
+// ErrStateIncomplete is returned when state queries got no reply, e.g. as the
+// amplifier isn't connected, or were still rejected after retrying.
+type ErrStateIncomplete struct {
+	Missing  []Command
+	Rejected []Command
+}
+
+func (e *ErrStateIncomplete) Error() string {
+	var msgs []string
+	if len(e.Missing) > 0 {
+		msgs = append(msgs, "No reply to state queries "+commandCodes(e.Missing))
+	}
+	if len(e.Rejected) > 0 {
+		msgs = append(msgs, "State queries "+commandCodes(e.Rejected)+" rejected")
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// commandCodes returns the group and number of the commands, e.g. "01,01
+// 03,01".
+func commandCodes(commands []Command) string {
+	codes := make([]string, len(commands))
+	for i, c := range commands {
+		codes[i] = c.Group + "," + c.Number
+	}
+	return strings.Join(codes, " ")
+}
+
+// ErrInvalidReply is returned for data from the amplifier which isn't a valid
+// reply.
+type ErrInvalidReply struct {
+	// Reason tells what's invalid, e.g. "source trim".
+	Reason string
+	Data   string
+}
+
+func (e *ErrInvalidReply) Error() string {
+	return fmt.Sprintf("Invalid %s: %q", e.Reason, e.Data)
+}
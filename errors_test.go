@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestErrorTypes(t *testing.T) {
+	a, port := newQueriedAmp(t, func(a *Amplifier) { a.confirmTimeout = 20 * time.Millisecond })
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		reply        string
+		notAvailable bool
+	}{{"#00,03", false}, {"#00,04", true}} {
+		port.onCommand(func(Command) []string { return []string{tt.reply} })
+		err := a.sendAndConfirm(ctx, SetMuteOn)
+		var rejected *ErrCommandRejected
+		if !errors.As(err, &rejected) || rejected.Command != SetMuteOn || rejected.NotAvailable() != tt.notAvailable {
+			t.Errorf("Replied %s: %v, want the mute rejected, not available %v", tt.reply, err, tt.notAvailable)
+		}
+	}
+
+	port.onCommand(func(Command) []string { return nil })
+	err := a.sendAndConfirm(ctx, SetMuteOn)
+	var timeout *ErrReplyTimeout
+	if !errors.As(err, &timeout) || timeout.Command != SetMuteOn || timeout.Timeout != a.confirmTimeout {
+		t.Errorf("No reply: %v, want a reply timeout", err)
+	}
+
+	if _, err := parseReply("garbage"); !errors.As(err, new(*ErrInvalidReply)) {
+		t.Errorf("parseReply(garbage) = %v, want an invalid reply", err)
+	}
+	if _, _, err := parseTrim("zz"); !errors.As(err, new(*ErrInvalidReply)) {
+		t.Errorf("parseTrim(zz) = %v, want an invalid reply", err)
+	}
+
+	port.Close()
+	err = a.sendAndConfirm(ctx, SetMuteOn)
+	var closed *ErrPortClosed
+	if !errors.As(err, &closed) || !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Closed port: %v, want the port closed", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{&ErrCommandRejected{Reply: Reply{Group: "00", Number: "03"}}, http.StatusBadGateway},
+		{&ErrCommandRejected{Reply: Reply{Group: "00", Number: "04"}}, http.StatusConflict},
+		{fmt.Errorf("Step 2: %w", &ErrReplyTimeout{}), http.StatusGatewayTimeout},
+		{&ErrPortClosed{Err: os.ErrClosed}, http.StatusServiceUnavailable},
+		{&ErrInvalidReply{Reason: "reply format"}, http.StatusBadGateway},
+		{fmt.Errorf("%w: power off", errForbidden), http.StatusForbidden},
+		{errors.New("Unexpected"), http.StatusInternalServerError},
+	} {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("errorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
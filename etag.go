@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxStatusWait bounds the ?wait= long-poll of /status.
+const maxStatusWait = 5 * time.Minute
+
+// statusETag returns a weak ETag of the status.
+func statusETag(resp statusResponse) string {
+	buf, _ := json.Marshal(resp)
+	return fmt.Sprintf(`W/"%x"`, sha256.Sum256(buf))
+}
+
+// stateChanges returns a channel closed on the next reply updating the
+// state.
+func (a *Amplifier) stateChanges() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.changed == nil {
+		a.changed = make(chan struct{})
+	}
+	return a.changed
+}
+
+// notifyChanged wakes the stateChanges waiters, a.mu must be held.
+func (a *Amplifier) notifyChanged() {
+	if a.changed != nil {
+		close(a.changed)
+		a.changed = nil
+	}
+}
+
+// waitForChange handles the If-None-Match header and the wait query
+// parameter of a GET /status request. With wait the request is held until
+// the state differs from the If-None-Match one, or the current one without
+// it, or the wait elapses. It replies 304 when the state still matches
+// If-None-Match, returning false when the request was answered.
+func (a *Amplifier) waitForChange(w http.ResponseWriter, r *http.Request) bool {
+	match := r.Header.Get("If-None-Match")
+
+	var wait time.Duration
+	if s := r.URL.Query().Get("wait"); s != "" {
+		var err error
+		wait, err = time.ParseDuration(s)
+		if err != nil || wait < 0 {
+			writeError(w, fmt.Sprintf("Invalid wait %q, expected a duration, e.g. 30s", s), http.StatusBadRequest)
+			return false
+		}
+		wait = min(wait, maxStatusWait)
+	}
+
+	etag := statusETag(a.status())
+	if wait > 0 {
+		base := match
+		if base == "" {
+			base = etag
+		}
+		timeout := a.clock.After(wait)
+		for etag == base {
+			changes := a.stateChanges()
+			// The state may have changed before watching it.
+			if etag = statusETag(a.status()); etag != base {
+				break
+			}
+			select {
+			case <-changes:
+				etag = statusETag(a.status())
+			case <-timeout:
+				base = ""
+			case <-r.Context().Done():
+				return false
+			}
+		}
+	}
+
+	if match != "" && etag == match {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getStatus sends GET path with the If-None-Match header, if any.
+func getStatus(t *testing.T, srv *httptest.Server, path, match string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match != "" {
+		req.Header.Set("If-None-Match", match)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestStatusETag(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp := getStatus(t, srv, "/status", "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != 200 || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("GET /status = %d with ETag %q, want 200 with a weak ETag", resp.StatusCode, etag)
+	}
+	if resp := getStatus(t, srv, "/status", etag); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Errorf("GET /status unchanged = %d with ETag %q, want 304", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	port.push("#02,03,1")
+	waitFor(t, "the mute", func() bool { return a.State().Mute })
+	resp = getStatus(t, srv, "/status", etag)
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") == etag {
+		t.Errorf("GET /status changed = %d with ETag %q, want 200 with a new ETag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	if resp := getStatus(t, srv, "/status?wait=soon", ""); resp.StatusCode != 400 {
+		t.Errorf("GET /status?wait=soon = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestStatusLongPoll(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	a, port := newQueriedAmp(t, func(a *Amplifier) { a.clock = clock })
+	srv := serve(t, a)
+	etag := getStatus(t, srv, "/status", "").Header.Get("ETag")
+
+	// Woken up by a state change.
+	done := make(chan *http.Response)
+	pending := clock.pending()
+	go func() { done <- getStatus(t, srv, "/status?wait=1m", etag) }()
+	waitFor(t, "the long-poll", func() bool { return clock.pending() > pending })
+	port.push("#02,03,1")
+	select {
+	case resp := <-done:
+		if resp.StatusCode != 200 || resp.Header.Get("ETag") == etag {
+			t.Errorf("Long-poll after a change = %d with ETag %q, want 200 with a new ETag", resp.StatusCode, resp.Header.Get("ETag"))
+		}
+		etag = resp.Header.Get("ETag")
+	case <-time.After(time.Second):
+		t.Fatal("Long-poll not woken up by the state change")
+	}
+
+	// Or not modified once the wait elapses.
+	pending = clock.pending()
+	go func() { done <- getStatus(t, srv, "/status?wait=1m", etag) }()
+	waitFor(t, "the long-poll", func() bool { return clock.pending() > pending })
+	clock.Advance(time.Minute)
+	if resp := <-done; resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Long-poll timed out = %d, want 304", resp.StatusCode)
+	}
+}
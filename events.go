@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Event types
+const (
+	eventState      = "state"
+	eventConnection = "connection"
+)
+
+// Event is published to the subscribers when a reply changed the amplifier
+// state, or when the serial connection status changed.
+type Event struct {
+	Type string `json:"type"`
+
+	// Fields are the JSON names of the changed state fields, and State the
+	// new state, for state events.
+	Fields []string        `json:"fields,omitempty"`
+	State  *AmplifierState `json:"state,omitempty"`
+
+	// Connection is the new connection status, with the error causing it
+	// if any, for connection events.
+	Connection string `json:"connection,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// changedFields returns the JSON names of the fields differing between the
+// states.
+func changedFields(prev, cur AmplifierState) []string {
+	var fields []string
+	p, c := reflect.ValueOf(prev), reflect.ValueOf(cur)
+	for i, f := range reflect.VisibleFields(p.Type()) {
+		if reflect.DeepEqual(p.Field(i).Interface(), c.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// Subscribe returns a channel receiving the events until the returned cancel
+// function is called. Events are dropped for subscribers which are not
+// keeping up.
+func (a *Amplifier) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	a.subscribersMu.Lock()
+	if a.subscribers == nil {
+		a.subscribers = make(map[chan Event]struct{})
+	}
+	a.subscribers[ch] = struct{}{}
+	a.subscribersMu.Unlock()
+
+	return ch, func() {
+		a.subscribersMu.Lock()
+		delete(a.subscribers, ch)
+		a.subscribersMu.Unlock()
+	}
+}
+
+// publish passes the event to the subscribers.
+func (a *Amplifier) publish(e Event) {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	for ch := range a.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishChanges publishes the change from prev to the current state, if
+// any, a.mu must be held.
+func (a *Amplifier) publishChanges(prev AmplifierState) {
+	fields := changedFields(prev, a.state)
+	if len(fields) == 0 {
+		return
+	}
+	state := a.copyState()
+	a.publish(Event{Type: eventState, Fields: fields, State: &state})
+}
+
+// stopStreams ends the event streams, which would otherwise keep the server
+// waiting on shutdown.
+func (a *Amplifier) stopStreams() {
+	a.streamsOnce.Do(func() { close(a.streamsDone) })
+}
+
+// serveEvents streams the events as server-sent events until the client goes
+// away or the server shuts down.
+func (a *Amplifier) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-events:
+			buf, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("error, encoding event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, buf); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-a.streamsDone:
+			return
+		}
+	}
+}
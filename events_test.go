@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestStateEvents(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	a.UpdateState(&Reply{Group: "02", Number: "03", Data: "1"})
+	select {
+	case e := <-events:
+		if e.Type != eventState || !slices.Equal(e.Fields, []string{"mute", "muteChangedAt"}) || e.State == nil || !e.State.Mute {
+			t.Errorf("Event = %+v, want the mute change", e)
+		}
+	default:
+		t.Fatal("No event after muting")
+	}
+
+	// Replies confirming the state, or not changing it, aren't published.
+	a.UpdateState(&Reply{Group: "02", Number: "03", Data: "1"})
+	a.UpdateState(&Reply{Group: "04", Number: "01", Data: "99"})
+	a.UpdateState(&Reply{Group: "00", Number: "04"})
+	select {
+	case e := <-events:
+		t.Errorf("Event %+v after no-op replies, want none", e)
+	default:
+	}
+
+	a.UpdateState(&Reply{Group: "04", Number: "01", Data: "05"})
+	a.UpdateState(&Reply{Group: "02", Number: "03", Data: "0"})
+	for _, want := range []string{"source", "mute"} {
+		select {
+		case e := <-events:
+			if !slices.Contains(e.Fields, want) {
+				t.Errorf("Event fields %v, want %s", e.Fields, want)
+			}
+		default:
+			t.Errorf("No event for the %s change", want)
+		}
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	slow, cancel := a.Subscribe()
+	defer cancel()
+	gone, cancelGone := a.Subscribe()
+	cancelGone()
+
+	// A subscriber not reading doesn't block the updates.
+	for i := range 100 {
+		a.UpdateState(&Reply{Group: "02", Number: "37", Data: strconv.Itoa(i)})
+	}
+	if got := len(slow); got != cap(slow) {
+		t.Errorf("Slow subscriber got %d events, want %d buffered", got, cap(slow))
+	}
+	if got := len(gone); got != 0 {
+		t.Errorf("Cancelled subscriber got %d events, want 0", got)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+func TestMain(m *testing.M) {
+	// The amplifier logs every reply, only show it with -v.
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// fakePort is an in-memory serial port emulating the amplifier: the commands
+// written to it are recorded and answered from its state, as the amplifier
+// would. Read blocks until a reply or pushed data is available, or the port
+// is closed.
+type fakePort struct {
+	mu      sync.Mutex
+	state   map[string]string
+	written []Command
+	output  []byte
+
+	// respond, if set, returns the reply frames to a command, without
+	// their terminator, instead of the emulated ones. No frames withholds
+	// the reply.
+	respond func(c Command) []string
+
+	// writeErr, if set, fails the writes it returns an error for.
+	writeErr func(c Command) error
+
+	terminator string
+	reads      chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// newFakePort returns a fake amplifier which is on, unmuted on D1.
+func newFakePort() *fakePort {
+	return &fakePort{
+		state: map[string]string{
+			"01,01": "1",     // Power
+			"01,03": "0",     // Mute
+			"01,24": "0",     // Speaker output
+			"01,26": "0",     // Headphones
+			"01,27": "1",     // Speakers
+			"01,28": "2",     // Display brightness
+			"01,30": "0",     // Auto power down
+			"01,32": "30",    // Startup volume
+			"01,34": "80",    // Max volume
+			"01,36": "0",     // Protection
+			"01,37": "45",    // Temperature
+			"03,01": "04",    // Source
+			"05,01": "0",     // Bass
+			"05,03": "0",     // Treble
+			"05,05": "0",     // Balance
+			"13,01": "1.0",   // Protocol version
+			"13,02": "2.1",   // Firmware version
+			"13,03": "CXA81", // Model
+			"13,04": "SN123", // Serial number
+		},
+		terminator: "\r",
+		reads:      make(chan []byte, 1024),
+		closed:     make(chan struct{}),
+	}
+}
+
+// set updates the fake amplifier state of a get command.
+func (f *fakePort) set(c Command, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.state[c.Group+","+c.Number] = data
+}
+
+func (f *fakePort) Read(b []byte) (int, error) {
+	select {
+	case buf := <-f.reads:
+		return copy(b, buf), nil
+	case <-f.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (f *fakePort) Write(b []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+
+	c, err := parseCommand(strings.TrimSuffix(string(b), f.terminator))
+	if err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	if f.writeErr != nil {
+		if err := f.writeErr(c); err != nil {
+			f.mu.Unlock()
+			return 0, err
+		}
+	}
+	f.written = append(f.written, c)
+	f.output = append(f.output, b...)
+	respond := f.respond
+	var frames []string
+	if respond == nil {
+		frames = f.emulate(c)
+	}
+	f.mu.Unlock()
+	if respond != nil {
+		frames = respond(c)
+	}
+
+	f.push(frames...)
+	return len(b), nil
+}
+
+func (f *fakePort) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// onCommand sets the replies to the commands, see respond.
+func (f *fakePort) onCommand(respond func(c Command) []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.respond = respond
+}
+
+// push queues the frames to be read, as sent by the amplifier unprompted.
+func (f *fakePort) push(frames ...string) {
+	for _, frame := range frames {
+		f.pushRaw(frame + f.terminator)
+	}
+}
+
+// pushRaw queues data to be read as is, in one read.
+func (f *fakePort) pushRaw(data string) {
+	f.reads <- []byte(data)
+}
+
+// commands returns the commands written so far.
+func (f *fakePort) commands() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.written)
+}
+
+// bytes returns the data written so far.
+func (f *fakePort) bytes() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return string(f.output)
+}
+
+// reset forgets the commands written so far.
+func (f *fakePort) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.written = nil
+	f.output = nil
+}
+
+// parseCommand parses a command frame, e.g. #01,02,1.
+func parseCommand(frame string) (Command, error) {
+	parts := strings.SplitN(strings.TrimPrefix(frame, "#"), ",", 3)
+	if !strings.HasPrefix(frame, "#") || len(parts) < 2 {
+		return Command{}, fmt.Errorf("Invalid command frame %q", frame)
+	}
+	c := Command{Group: parts[0], Number: parts[1]}
+	if len(parts) == 3 {
+		c.Data = parts[2]
+	}
+	return c, nil
+}
+
+// fakeSources is the order the fake amplifier cycles the sources in.
+var fakeSources = []string{"00", "01", "02", "03", "04", "05", "06", "10", "14", "16", "20"}
+
+// emulate returns the replies of the amplifier to the command, f.mu must be
+// held.
+func (f *fakePort) emulate(c Command) []string {
+	if f.state["01,01"] != "1" && needsPower(c) {
+		return []string{"#00,04"}
+	}
+	reply := func(number, data string) []string {
+		return []string{fmt.Sprintf("#%s,%s,%s", replyGroup(c), number, data)}
+	}
+
+	switch c.Group + "," + c.Number {
+	case "03,02", "03,03":
+		i := slices.Index(fakeSources, f.state["03,01"])
+		if c.Number == "02" {
+			i = (i + 1) % len(fakeSources)
+		} else {
+			i = (i + len(fakeSources) - 1) % len(fakeSources)
+		}
+		f.state["03,01"] = fakeSources[i]
+		return reply("01", f.state["03,01"])
+	case "03,04":
+		f.state["03,01"] = c.Data
+		return reply("01", c.Data)
+	case "03,05":
+		level, ok := f.state["trim,"+c.Data]
+		if !ok {
+			level = "+0"
+		}
+		return reply("05", c.Data+level)
+	case "03,06":
+		f.state["trim,"+c.Data[:2]] = c.Data[2:]
+		return reply("05", c.Data)
+	case "03,07":
+		return reply("07", "1")
+	}
+
+	if data, ok := f.state[c.Group+","+c.Number]; ok && c.Data == "" {
+		return reply(c.Number, data)
+	}
+	// Set commands follow their get command.
+	if number, ok := confirmingReply[[2]string{c.Group, c.Number}]; ok {
+		if _, ok := f.state[c.Group+","+number]; ok {
+			f.state[c.Group+","+number] = c.Data
+			return reply(number, c.Data)
+		}
+	}
+	return []string{"#00,02"}
+}
+
+// fakeSerial is a fakePort with the serial.Port methods, for openPort.
+type fakeSerial struct{ *fakePort }
+
+func (fakeSerial) SetMode(*serial.Mode) error { return nil }
+func (fakeSerial) Drain() error               { return nil }
+func (fakeSerial) ResetInputBuffer() error    { return nil }
+func (fakeSerial) ResetOutputBuffer() error   { return nil }
+func (fakeSerial) SetDTR(bool) error          { return nil }
+func (fakeSerial) SetRTS(bool) error          { return nil }
+func (fakeSerial) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+func (fakeSerial) SetReadTimeout(time.Duration) error { return nil }
+func (fakeSerial) Break(time.Duration) error          { return nil }
+
+// stubOpenPort replaces openPort for the test.
+func stubOpenPort(t *testing.T, opener PortOpener) {
+	t.Helper()
+	orig := openPort
+	openPort = opener
+	t.Cleanup(func() { openPort = orig })
+}
+
+// newTestAmp returns an amplifier on a fake port, set up by the options then
+// started, and closed at the end of the test.
+func newTestAmp(t *testing.T, options ...func(*Amplifier)) (*Amplifier, *fakePort) {
+	t.Helper()
+	port := newFakePort()
+	a := NewAmplifierWithPort(port)
+	for _, option := range options {
+		option(a)
+	}
+	a.Start(context.Background())
+	t.Cleanup(func() { a.Close() })
+	return a, port
+}
+
+// newQueriedAmp returns a started amplifier on a fake port, see newTestAmp,
+// with its state queried.
+func newQueriedAmp(t *testing.T, options ...func(*Amplifier)) (*Amplifier, *fakePort) {
+	t.Helper()
+	a, port := newTestAmp(t, options...)
+	if _, err := a.QueryAll(context.Background()); err != nil {
+		t.Fatalf("QueryAll: %v", err)
+	}
+	// Powering on from the initial state queries the source and mute.
+	want := len(a.stateQueries()) + 2
+	if a.State().Power {
+		want += 2
+	}
+	waitFor(t, "the power on queries", func() bool { return len(port.commands()) == want })
+	// The replies are read in order, so theirs are handled once this one is.
+	if err := a.sendAndConfirm(context.Background(), GetPowerState); err != nil {
+		t.Fatalf("Confirming the power on queries: %v", err)
+	}
+	port.reset()
+	return a, port
+}
+
+// serve serves the amplifier routes, with the raw command endpoint.
+func serve(t *testing.T, a *Amplifier) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(a.routes(true, false))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// request sends a request to the test server, returning the response and its
+// body.
+func request(t *testing.T, srv *httptest.Server, method, path, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(buf)
+}
+
+// waitFor polls cond until it's true, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// ptr returns a pointer to v, for the optional request fields.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// pending returns the number of timers waiting for the clock to advance.
+func (c *FakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// captureLog returns the log output until the end of the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	var b syncBuffer
+	orig := log.Writer()
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(orig) })
+	return &b
+}
+
+// testConfig returns a configuration for an amplifier on the named port,
+// opened with openPort.
+func testConfig(port string) *Config {
+	return &Config{
+		Port:             port,
+		Model:            CXA81,
+		LineEnding:       "cr",
+		OpenAttempts:     1,
+		ConfirmTimeout:   100 * time.Millisecond,
+		ReconnectInitial: 10 * time.Millisecond,
+		ReconnectMax:     10 * time.Millisecond,
+		ReconnectFactor:  1,
+		Standby:          "reject",
+		HistorySize:      defaultHistorySize,
+	}
+}
+
+// fakeOpener is a PortOpener opening a new fake amplifier.
+func fakeOpener(string, *serial.Mode) (serial.Port, error) {
+	return fakeSerial{newFakePort()}, nil
+}
@@ -5,6 +5,8 @@ go 1.23.1
 require (
 	github.com/google/go-cmp v0.6.0
 	go.bug.st/serial v1.6.2
+	golang.org/x/time v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
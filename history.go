@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultHistorySize is the number of replies kept when not configured.
+const defaultHistorySize = 100
+
+// historyEntry is a reply with the time it was received.
+type historyEntry struct {
+	Time  time.Time `json:"time"`
+	Reply Reply     `json:"reply"`
+	Desc  string    `json:"desc"`
+}
+
+// replyHistory is a fixed size ring buffer of the latest replies.
+type replyHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+// newReplyHistory returns a history keeping the last size replies.
+func newReplyHistory(size int) *replyHistory {
+	return &replyHistory{entries: make([]historyEntry, size)}
+}
+
+// add appends the reply, overwriting the oldest one when full.
+func (h *replyHistory) add(r *Reply) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = historyEntry{Time: time.Now().UTC(), Reply: *r, Desc: r.String()}
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the replies from the oldest to the latest.
+func (h *replyHistory) list() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.full {
+		return append([]historyEntry{}, h.entries[:h.next]...)
+	}
+	return append(append([]historyEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// serveLog replies with the latest replies received from the amplifier.
+func (a *Amplifier) serveLog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.history.list())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestReplyHistory(t *testing.T) {
+	h := newReplyHistory(3)
+	for i := range 5 {
+		h.add(&Reply{Group: "02", Number: "37", Data: strconv.Itoa(40 + i)})
+	}
+
+	var got []string
+	for _, e := range h.list() {
+		got = append(got, e.Reply.Data)
+	}
+	if want := []string{"42", "43", "44"}; !slices.Equal(got, want) {
+		t.Errorf("History %v, want the latest %v", got, want)
+	}
+
+	if got := newReplyHistory(0); len(got.list()) != 0 {
+		t.Error("Empty history kept replies")
+	}
+}
+
+func TestServeLog(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	_, body := request(t, serve(t, a), "GET", "/log", "")
+
+	var entries []historyEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0].Desc != "Current power state: On" || entries[0].Time.IsZero() {
+		t.Errorf("GET /log = %s, want the replies from the power state", body)
+	}
+}
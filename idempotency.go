@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeys bounds the responses kept for the Idempotency-Key
+// header, the oldest are dropped first.
+const maxIdempotencyKeys = 1024
+
+// idempotentResponse is the response to the first request with a key, done is
+// closed once it's recorded.
+type idempotentResponse struct {
+	done    chan struct{}
+	expires time.Time
+	code    int
+	header  http.Header
+	body    []byte
+}
+
+// idempotencyCache holds the responses by key until they expire.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+// lookup returns the response for the key, and whether it's from an earlier
+// request. Otherwise the returned response is to be recorded by the caller
+// and completed with finish.
+func (c *idempotencyCache) lookup(key string, now time.Time) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e, true
+	}
+	if len(c.entries) >= maxIdempotencyKeys {
+		c.evict(now)
+	}
+	e := &idempotentResponse{done: make(chan struct{})}
+	c.entries[key] = e
+	return e, false
+}
+
+// evict drops the expired responses, or the oldest one when none has
+// expired. Responses still being recorded are kept. c.mu must be held.
+func (c *idempotencyCache) evict(now time.Time) {
+	var oldest string
+	for key, e := range c.entries {
+		switch {
+		case e.expires.IsZero():
+		case !now.Before(e.expires):
+			delete(c.entries, key)
+		case oldest == "" || e.expires.Before(c.entries[oldest].expires):
+			oldest = key
+		}
+	}
+	if len(c.entries) >= maxIdempotencyKeys && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// finish records the response and releases the requests waiting for it.
+func (c *idempotencyCache) finish(e *idempotentResponse, rec *recordingWriter, now time.Time) {
+	c.mu.Lock()
+	e.expires = now.Add(c.ttl)
+	c.mu.Unlock()
+
+	e.code = rec.code
+	if e.code == 0 {
+		e.code = http.StatusOK
+	}
+	e.header = rec.Header().Clone()
+	e.body = rec.body.Bytes()
+	close(e.done)
+}
+
+// recordingWriter keeps a copy of the response it writes.
+type recordingWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// withIdempotency replies to mutating requests repeating the Idempotency-Key
+// of one within ttl with its response, without serving them again, so that
+// clients retrying after a network error don't apply a change, e.g. a
+// toggle, twice. Keys are per HTTP auth user, method and path. A repeat of a
+// request still being served waits for its response.
+func withIdempotency(ttl time.Duration, next http.Handler) http.Handler {
+	cache := &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotentResponse)}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if !isMutating(r) || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, _, _ := r.BasicAuth()
+		e, found := cache.lookup(user+" "+r.Method+" "+r.URL.Path+" "+key, time.Now())
+		if !found {
+			rec := &recordingWriter{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			cache.finish(e, rec, time.Now())
+			return
+		}
+
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return
+		}
+		maps.Copy(w.Header(), e.header)
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(e.code)
+		w.Write(e.body)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := httptest.NewServer(withIdempotency(time.Hour, a.routes(false, false)))
+	defer srv.Close()
+
+	// toggle toggles the mute with the key, returning the response.
+	toggle := func(key string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL+"/mute/toggle", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		if _, err := io.Copy(&body, resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		return resp, body.String()
+	}
+
+	first, firstBody := toggle("k1")
+	// Retries, concurrent ones too, are replied the first response.
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := toggle("k1")
+			if resp.StatusCode != first.StatusCode || body != firstBody || resp.Header.Get("Idempotent-Replayed") != "true" {
+				t.Errorf("Retry = %d %s, want the replayed %d %s", resp.StatusCode, body, first.StatusCode, firstBody)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := port.commands(); !slices.Equal(got, []Command{SetMuteOn}) {
+		t.Errorf("Sent %v for one key, want %v once", got, SetMuteOn)
+	}
+	if !a.State().Mute {
+		t.Error("Not muted after the toggle")
+	}
+
+	// Other keys and requests without one are served.
+	toggle("k2")
+	toggle("")
+	if got, want := port.commands(), []Command{SetMuteOn, SetMuteOff, SetMuteOn}; !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	var calls int
+	h := withIdempotency(20*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	post := func() {
+		r := httptest.NewRequest("POST", "/mute/toggle", nil)
+		r.Header.Set("Idempotency-Key", "k")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	post()
+	post()
+	if calls != 1 {
+		t.Errorf("Served %d times within the TTL, want 1", calls)
+	}
+	time.Sleep(30 * time.Millisecond)
+	post()
+	if calls != 2 {
+		t.Errorf("Served %d times after the TTL, want 2", calls)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// JSON field name styles
+const (
+	jsonCamel = "camel"
+	jsonSnake = "snake"
+)
+
+// Only keys which are field names are renamed, not data keys such as the
+// source names of the trims.
+var (
+	camelKey = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+	snakeKey = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// toSnake returns the camelCase name in snake_case.
+func toSnake(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// toCamel returns the snake_case name in camelCase.
+func toCamel(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// renameKeys renames the object keys of the decoded JSON value matching
+// keys with rename, recursively.
+func renameKeys(v any, keys *regexp.Regexp, rename func(string) string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		renamed := make(map[string]any, len(v))
+		for k, e := range v {
+			// The fields of the state events name fields too.
+			if names, ok := e.([]any); ok && k == "fields" {
+				for i, name := range names {
+					if name, ok := name.(string); ok && keys.MatchString(name) {
+						names[i] = rename(name)
+					}
+				}
+			}
+			if keys.MatchString(k) {
+				k = rename(k)
+			}
+			renamed[k] = renameKeys(e, keys, rename)
+		}
+		return renamed
+	case []any:
+		for i, e := range v {
+			v[i] = renameKeys(e, keys, rename)
+		}
+	}
+	return v
+}
+
+// convertJSON renames the keys of the JSON document, returning it unchanged
+// if it can't be decoded.
+func convertJSON(buf []byte, keys *regexp.Regexp, rename func(string) string) []byte {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return buf
+	}
+	out, err := json.Marshal(renameKeys(v, keys, rename))
+	if err != nil {
+		return buf
+	}
+	return append(out, '\n')
+}
+
+// snakeWriter buffers JSON responses to rename their keys in snake_case, and
+// renames those of the server-sent events data as they are written.
+type snakeWriter struct {
+	http.ResponseWriter
+	code int
+	buf  bytes.Buffer
+}
+
+func (w *snakeWriter) WriteHeader(code int) {
+	if w.isJSON() {
+		w.code = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *snakeWriter) isJSON() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+}
+
+func (w *snakeWriter) Write(b []byte) (int, error) {
+	switch {
+	case w.isJSON():
+		return w.buf.Write(b)
+	case strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream"):
+		lines := strings.Split(string(b), "\n")
+		for i, line := range lines {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				lines[i] = "data: " + strings.TrimSuffix(string(convertJSON([]byte(data), camelKey, toSnake)), "\n")
+			}
+		}
+		if _, err := io.WriteString(w.ResponseWriter, strings.Join(lines, "\n")); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *snakeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.isJSON() {
+		f.Flush()
+	}
+}
+
+// finish writes the buffered JSON response.
+func (w *snakeWriter) finish() {
+	if !w.isJSON() {
+		return
+	}
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(convertJSON(w.buf.Bytes(), camelKey, toSnake))
+	}
+}
+
+// withJSONStyle serves the JSON field names in snake_case for the snake
+// style, accepting them so in request bodies and the fields parameter too.
+func withJSONStyle(style string, next http.Handler) http.Handler {
+	if style != jsonSnake {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && isMutating(r) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(bytes.TrimSpace(body)) > 0 {
+				body = convertJSON(body, snakeKey, toCamel)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if fields := r.URL.Query().Get("fields"); fields != "" {
+			names := strings.Split(fields, ",")
+			for i, name := range names {
+				names[i] = toCamel(strings.TrimSpace(name))
+			}
+			q := r.URL.Query()
+			q.Set("fields", strings.Join(names, ","))
+			r.URL.RawQuery = q.Encode()
+		}
+
+		sw := &snakeWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		sw.finish()
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToSnake(t *testing.T) {
+	for camel, snake := range map[string]string{
+		"power":             "power",
+		"speakerOutput":     "speaker_output",
+		"displayBrightness": "display_brightness",
+		"muteChangedAt":     "mute_changed_at",
+	} {
+		if got := toSnake(camel); got != snake {
+			t.Errorf("toSnake(%q) = %q, want %q", camel, got, snake)
+		}
+		if got := toCamel(snake); got != camel {
+			t.Errorf("toCamel(%q) = %q, want %q", snake, got, camel)
+		}
+	}
+}
+
+func TestJSONStyle(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	port.push("#04,05,05+2")
+	waitFor(t, "the trim", func() bool { return a.State().Trims != nil })
+
+	for _, tt := range []struct {
+		style     string
+		want, not []string
+	}{
+		{jsonCamel, []string{`"firmwareVersion":"2.1"`, `"powerChangedAt":`, `"trims":{"D2":2}`}, []string{"firmware_version"}},
+		{jsonSnake, []string{`"firmware_version":"2.1"`, `"power_changed_at":`, `"trims":{"D2":2}`}, []string{"firmwareVersion", `"d2"`}},
+	} {
+		srv := httptest.NewServer(withJSONStyle(tt.style, a.routes(false, false)))
+		_, body := request(t, srv, "GET", "/status", "")
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: GET /status = %s, want %s", tt.style, body, want)
+			}
+		}
+		for _, not := range tt.not {
+			if strings.Contains(body, not) {
+				t.Errorf("%s: GET /status = %s, want no %s", tt.style, body, not)
+			}
+		}
+		srv.Close()
+	}
+
+	// Snake case names are accepted in the fields parameter too.
+	srv := httptest.NewServer(withJSONStyle(jsonSnake, a.routes(false, false)))
+	defer srv.Close()
+	if _, body := request(t, srv, "GET", "/status?fields=firmware_version", ""); body != "{\"firmware_version\":\"2.1\"}\n" {
+		t.Errorf("GET /status?fields=firmware_version = %s", body)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseLabels checks the source labels from the configuration, returning them
+// by source name.
+func parseLabels(labels map[string]string) (map[string]string, error) {
+	byName := make(map[string]string, len(labels))
+	seen := make(map[string]string, len(labels))
+	for s, label := range labels {
+		src, ok := lookupSource(s)
+		if !ok {
+			return nil, fmt.Errorf("Unknown source %q in labels", s)
+		}
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return nil, fmt.Errorf("Empty label for source %s", src.Name)
+		}
+		if other, ok := lookupSource(label); ok && other.Name != src.Name {
+			return nil, fmt.Errorf("Label %q for source %s is the name of source %s", label, src.Name, other.Name)
+		}
+		key := strings.ToLower(label)
+		if other, ok := seen[key]; ok && other != src.Name {
+			return nil, fmt.Errorf("Duplicate label %q for sources %s and %s", label, other, src.Name)
+		}
+		seen[key] = src.Name
+		byName[src.Name] = label
+	}
+
+	return byName, nil
+}
+
+// findSource finds a source by its label, name or alias, ignoring case and
+// surrounding spaces.
+func (a *Amplifier) findSource(s string) (Source, bool) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	for name, label := range a.labels {
+		if strings.ToLower(label) == key {
+			return sourcesByName[strings.ToLower(name)], true
+		}
+	}
+
+	return lookupSource(s)
+}
+
+// displayName returns the label of the named source, or its name when it has
+// none.
+func (a *Amplifier) displayName(name string) string {
+	if label, ok := a.labels[name]; ok {
+		return label
+	}
+	return name
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels(map[string]string{"d1": " TV ", "bt": "Phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels["D1"] != "TV" || labels["Bluetooth"] != "Phone" {
+		t.Errorf("parseLabels = %v, want by source name", labels)
+	}
+
+	for _, tt := range []struct {
+		labels map[string]string
+		want   string
+	}{
+		{map[string]string{"tape": "Deck"}, "Unknown source"},
+		{map[string]string{"D1": " "}, "Empty label"},
+		{map[string]string{"D1": "D2"}, "name of source D2"},
+		{map[string]string{"D1": "TV", "D2": "tv"}, "Duplicate label"},
+	} {
+		if _, err := parseLabels(tt.labels); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseLabels(%v) = %v, want %q", tt.labels, err, tt.want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	a, port := newQueriedAmp(t, func(a *Amplifier) { a.labels = map[string]string{"D2": "TV"} })
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/status", `{"source": "tv"}`)
+	if resp.StatusCode != 200 || !strings.Contains(body, `"displayName":"TV"`) {
+		t.Errorf("POST source by label = %d %s, want D2 shown as TV", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 1 || got[0] != SetSourceD2 {
+		t.Errorf("Sent %v, want %v", got, SetSourceD2)
+	}
+	_, body = request(t, srv, "GET", "/api/sources", "")
+	if !strings.Contains(body, `"name":"D2","displayName":"TV"`) {
+		t.Errorf("GET /api/sources = %s, want the D2 label", body)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix selects a Unix domain socket as the listen address.
+const unixPrefix = "unix:"
+
+// unixSocketMode lets the owner and group use the socket.
+const unixSocketMode = 0o660
+
+// listenOn listens on the TCP or unix:/path address. A stale socket left by a
+// previous run is removed, and the socket is removed again when the listener
+// is closed.
+func listenOn(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("Can't listen on %s, the file exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
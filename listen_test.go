@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cxa.sock")
+	// A stale socket left by a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenOn(unixPrefix + path)
+	if err != nil {
+		t.Fatalf("listenOn: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != unixSocketMode {
+		t.Errorf("Socket mode = %o, want %o", mode, unixSocketMode)
+	}
+
+	a, _ := newQueriedAmp(t)
+	srv := &http.Server{Handler: a.routes(false, false)}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://cxa/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(body), `"power"`) {
+		t.Errorf("GET /status = %d %s", resp.StatusCode, body)
+	}
+
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket not removed on close: %v", err)
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cxa.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenOn(unixPrefix + path); err == nil || !strings.Contains(err.Error(), "isn't a socket") {
+		t.Errorf("listenOn(%s) = %v, want an error", path, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("File removed: %v", err)
+	}
+}
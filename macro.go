@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MacroStep is one step of a macro, empty fields are left unchanged.
+type MacroStep struct {
+	Power    string `yaml:"power"`
+	Mute     string `yaml:"mute"`
+	Source   string `yaml:"source"`
+	Speakers string `yaml:"speakers"`
+}
+
+// request returns the step as a POST request, leaving the empty fields out.
+func (s MacroStep) request() *setRequest {
+	field := func(v string) *string {
+		if v == "" {
+			return nil
+		}
+		return &v
+	}
+	return &setRequest{Power: field(s.Power), Mute: field(s.Mute), Source: field(s.Source), SpeakerOutput: field(s.Speakers)}
+}
+
+// validateMacros checks the macro steps are accepted by an amplifier with
+// the given model and labels.
+func validateMacros(macros map[string][]MacroStep, model string, labels map[string]string) error {
+	a := &Amplifier{model: model}
+	var err error
+	if a.labels, err = parseLabels(labels); err != nil {
+		return err
+	}
+
+	for name, steps := range macros {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("Invalid macro name %q", name)
+		}
+		if len(steps) == 0 {
+			return fmt.Errorf("Macro %s has no steps", name)
+		}
+		for i, step := range steps {
+			if step == (MacroStep{}) {
+				return fmt.Errorf("Macro %s step %d is empty", name, i+1)
+			}
+			if err := step.request().Validate(a); err != nil {
+				return fmt.Errorf("Macro %s step %d: %v", name, i+1, strings.ReplaceAll(err.Error(), "\n", ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// runMacro applies the macro steps in order, stopping at the first error.
+func (a *Amplifier) runMacro(ctx context.Context, steps []MacroStep) error {
+	requests := make([]*setRequest, len(steps))
+	for i, step := range steps {
+		requests[i] = step.request()
+	}
+	if n, err := a.runSteps(ctx, requests); err != nil {
+		return fmt.Errorf("Step %d: %w", n+1, err)
+	}
+
+	return nil
+}
+
+// serveMacro runs the named macro and replies with the resulting state.
+func (a *Amplifier) serveMacro(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	steps, ok := a.macros[name]
+	if !ok {
+		writeError(w, fmt.Sprintf("Unknown macro: %s", name), http.StatusNotFound)
+		return
+	}
+
+	if err := a.runMacro(r.Context(), steps); err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	a.writeState(w)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMacro(t *testing.T) {
+	macros := map[string][]MacroStep{
+		"movie": {{Mute: "on"}, {Source: "tv", Mute: "off"}, {Speakers: "B"}},
+	}
+	a, port := newQueriedAmp(t, func(a *Amplifier) {
+		a.macros = macros
+		a.labels = map[string]string{"D2": "TV"}
+	})
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/macro/movie", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /macro/movie = %d %s", resp.StatusCode, body)
+	}
+	want := []Command{SetMuteOn, SetMuteOff, SetSourceD2, SetSpeakerB}
+	if got := port.commands(); !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+
+	resp, _ = request(t, srv, "POST", "/macro/party", "")
+	if resp.StatusCode != 404 {
+		t.Errorf("POST /macro/party = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestValidateMacros(t *testing.T) {
+	for _, tt := range []struct {
+		macros map[string][]MacroStep
+		want   string
+	}{
+		{map[string][]MacroStep{"a/b": {{Power: "on"}}}, "Invalid macro name"},
+		{map[string][]MacroStep{"empty": {}}, "no steps"},
+		{map[string][]MacroStep{"blank": {{Power: "on"}, {}}}, "step 2 is empty"},
+		{map[string][]MacroStep{"usb": {{Source: "USB"}}}, "isn't available on the CXA61"},
+		{map[string][]MacroStep{"bad": {{Mute: "loud"}}}, "step 1"},
+	} {
+		if err := validateMacros(tt.macros, CXA61, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("validateMacros(%v) = %v, want %q", tt.macros, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ampMetrics are the amplifier metrics exposed at /metrics.
+type ampMetrics struct {
+	parseErrors   atomic.Uint64
+	reconnections atomic.Uint64
+
+	// Command latencies, timeouts and commands sent by command group.
+	mu        sync.Mutex
+	latencies map[string]*histogram
+	timeouts  map[string]uint64
+	sent      map[string]uint64
+}
+
+// latencyBuckets are the upper bounds of the command latency buckets, in
+// seconds.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// histogram counts observations in latencyBuckets.
+type histogram struct {
+	counts []uint64 // Observations per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// observeLatency records the time the amplifier took to confirm a command.
+func (m *ampMetrics) observeLatency(c Command, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.latencies == nil {
+		m.latencies = make(map[string]*histogram)
+	}
+	h, ok := m.latencies[c.Group]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[c.Group] = h
+	}
+
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// observeTimeout counts a command the amplifier didn't confirm.
+func (m *ampMetrics) observeTimeout(c Command) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.timeouts == nil {
+		m.timeouts = make(map[string]uint64)
+	}
+	m.timeouts[c.Group]++
+}
+
+// observeSent counts a command written to the amplifier.
+func (m *ampMetrics) observeSent(c Command) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sent == nil {
+		m.sent = make(map[string]uint64)
+	}
+	m.sent[c.Group]++
+}
+
+// counts returns copies of the commands sent and timeouts by group.
+func (m *ampMetrics) counts() (sent, timeouts map[string]uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return maps.Clone(m.sent), maps.Clone(m.timeouts)
+}
+
+// serveMetrics replies with the metrics in the Prometheus text format.
+func (a *Amplifier) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m := &a.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP cxa81_parse_errors_total Replies from the amplifier which couldn't be parsed.")
+	fmt.Fprintln(w, "# TYPE cxa81_parse_errors_total counter")
+	fmt.Fprintf(w, "cxa81_parse_errors_total %d\n", m.parseErrors.Load())
+
+	up := 0
+	if status, _ := a.connection(); status == connConnected {
+		up = 1
+	}
+	fmt.Fprintln(w, "# HELP cxa81_up Whether the serial connection is up.")
+	fmt.Fprintln(w, "# TYPE cxa81_up gauge")
+	fmt.Fprintf(w, "cxa81_up %d\n", up)
+	if ns := a.lastReplyTime.Load(); ns != 0 {
+		fmt.Fprintln(w, "# HELP cxa81_last_reply_timestamp_seconds Time of the last reply from the amplifier.")
+		fmt.Fprintln(w, "# TYPE cxa81_last_reply_timestamp_seconds gauge")
+		fmt.Fprintf(w, "cxa81_last_reply_timestamp_seconds %s\n", strconv.FormatFloat(float64(ns)/1e9, 'f', 3, 64))
+	}
+
+	fmt.Fprintln(w, "# HELP cxa81_reconnections_total Times the serial port was reopened after an error.")
+	fmt.Fprintln(w, "# TYPE cxa81_reconnections_total counter")
+	fmt.Fprintf(w, "cxa81_reconnections_total %d\n", m.reconnections.Load())
+
+	// Every source is listed so only the current one is ever 1, all are 0
+	// in standby.
+	st := a.State()
+	current := st.Source
+	if !st.Power {
+		// The source may be kept as last known with keepStateOnOff.
+		current = ""
+	}
+	fmt.Fprintln(w, "# HELP cxa81_source Current source, 1 for the selected one.")
+	fmt.Fprintln(w, "# TYPE cxa81_source gauge")
+	for _, src := range sourceTable {
+		if !src.availableOn(a.model) {
+			continue
+		}
+		active := 0
+		if src.Name == current {
+			active = 1
+		}
+		fmt.Fprintf(w, "cxa81_source{source=%q} %d\n", src.Name, active)
+	}
+
+	if st.Protection != "" {
+		engaged := 0
+		if protectionEngaged(st.Protection) {
+			engaged = 1
+		}
+		fmt.Fprintln(w, "# HELP cxa81_protection Whether a protection shut the outputs down, by protection status.")
+		fmt.Fprintln(w, "# TYPE cxa81_protection gauge")
+		fmt.Fprintf(w, "cxa81_protection{status=%q} %d\n", st.Protection, engaged)
+	}
+	if st.Temperature != nil {
+		fmt.Fprintln(w, "# HELP cxa81_temperature_celsius Amplifier temperature.")
+		fmt.Fprintln(w, "# TYPE cxa81_temperature_celsius gauge")
+		fmt.Fprintf(w, "cxa81_temperature_celsius %d\n", *st.Temperature)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP cxa81_command_duration_seconds Time from sending a command to its confirmation.")
+	fmt.Fprintln(w, "# TYPE cxa81_command_duration_seconds histogram")
+	for _, group := range slices.Sorted(maps.Keys(m.latencies)) {
+		h := m.latencies[group]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "cxa81_command_duration_seconds_bucket{group=%q,le=%q} %d\n", group, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "cxa81_command_duration_seconds_bucket{group=%q,le=\"+Inf\"} %d\n", group, h.count)
+		fmt.Fprintf(w, "cxa81_command_duration_seconds_sum{group=%q} %g\n", group, h.sum)
+		fmt.Fprintf(w, "cxa81_command_duration_seconds_count{group=%q} %d\n", group, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP cxa81_command_timeouts_total Commands the amplifier didn't confirm in time.")
+	fmt.Fprintln(w, "# TYPE cxa81_command_timeouts_total counter")
+	for _, group := range slices.Sorted(maps.Keys(m.timeouts)) {
+		fmt.Fprintf(w, "cxa81_command_timeouts_total{group=%q} %d\n", group, m.timeouts[group])
+	}
+
+	fmt.Fprintln(w, "# HELP cxa81_commands_sent_total Commands written to the amplifier.")
+	fmt.Fprintln(w, "# TYPE cxa81_commands_sent_total counter")
+	for _, group := range slices.Sorted(maps.Keys(m.sent)) {
+		fmt.Fprintf(w, "cxa81_commands_sent_total{group=%q} %d\n", group, m.sent[group])
+	}
+}
+
+// logLimiter logs at most one message per interval, counting the ones
+// suppressed in between. The count is logged at the end of the interval, or
+// before the next message.
+type logLimiter struct {
+	interval time.Duration
+	clock    Clock
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+	summary    Timer
+}
+
+// Printf logs the message unless one was logged within the interval.
+func (l *logLimiter) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		if l.summary == nil {
+			l.summary = l.clock.AfterFunc(l.last.Add(l.interval).Sub(now), l.flush)
+		}
+		return
+	}
+	l.logSuppressed()
+	l.last = now
+	log.Printf(format, v...)
+}
+
+// flush logs the count of suppressed messages, if any.
+func (l *logLimiter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.logSuppressed()
+}
+
+// logSuppressed logs and resets the count of suppressed messages, l.mu must
+// be held.
+func (l *logLimiter) logSuppressed() {
+	if l.summary != nil {
+		l.summary.Stop()
+		l.summary = nil
+	}
+	if l.suppressed > 0 {
+		log.Printf("%d similar messages suppressed since %s", l.suppressed, l.last.Format(time.TimeOnly))
+		l.suppressed = 0
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrorLog(t *testing.T) {
+	out := captureLog(t)
+	a := NewAmplifierWithPort(newFakePort())
+	clock := NewFakeClock(time.Now())
+	a.parseLog = &logLimiter{interval: time.Minute, clock: clock}
+	port := a.port.(*fakePort)
+
+	for range 100 {
+		port.push("garbage")
+		if err := a.readUpdate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Count(out.String(), "Invalid reply format"); got != 1 {
+		t.Errorf("Logged %d of 100 parse errors within the interval, want 1:\n%s", got, out)
+	}
+	if strings.Contains(out.String(), "suppressed") {
+		t.Errorf("Log %q, want the suppressed count at the end of the interval", out)
+	}
+	clock.Advance(time.Minute)
+	waitFor(t, "the suppressed count", func() bool { return strings.Contains(out.String(), "99 similar messages suppressed") })
+	if got := a.metrics.parseErrors.Load(); got != 100 {
+		t.Errorf("Counted %d parse errors, want 100", got)
+	}
+}
+
+func TestCommandLatency(t *testing.T) {
+	a, _ := newTestAmp(t)
+	srv := serve(t, a)
+	if err := a.sendAndConfirm(context.Background(), GetSource); err != nil {
+		t.Fatalf("sendAndConfirm: %v", err)
+	}
+
+	_, body := request(t, srv, "GET", "/metrics", "")
+	for _, want := range []string{
+		`cxa81_command_duration_seconds_bucket{group="03",le="+Inf"} 1`,
+		`cxa81_command_duration_seconds_count{group="03"} 1`,
+		`cxa81_commands_sent_total{group="03"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics missing %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `cxa81_command_timeouts_total{`) {
+		t.Errorf("GET /metrics has timeouts after a confirmed command:\n%s", body)
+	}
+}
+
+func TestSourceGauge(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	// active returns the sources with the gauge at 1, and the number listed.
+	active := func() ([]string, int) {
+		_, body := request(t, srv, "GET", "/metrics", "")
+		var on []string
+		n := 0
+		for _, line := range strings.Split(body, "\n") {
+			label, ok := strings.CutPrefix(line, `cxa81_source{source="`)
+			if !ok {
+				continue
+			}
+			n++
+			if name, ok := strings.CutSuffix(label, `"} 1`); ok {
+				on = append(on, name)
+			}
+		}
+		return on, n
+	}
+
+	available := 0
+	for _, src := range sourceTable {
+		if src.availableOn(CXA81) {
+			available++
+		}
+	}
+	if on, n := active(); len(on) != 1 || on[0] != "D1" || n != available {
+		t.Errorf("Active sources = %v of %d, want D1", on, n)
+	}
+	port.push("#04,01,14")
+	waitFor(t, "the source change", func() bool { return a.State().Source == "Bluetooth" })
+	if on, _ := active(); len(on) != 1 || on[0] != "Bluetooth" {
+		t.Errorf("Active sources after the change = %v, want Bluetooth", on)
+	}
+	port.push("#02,01,0")
+	waitFor(t, "the standby", func() bool { return !a.State().Power })
+	if on, _ := active(); len(on) != 0 {
+		t.Errorf("Active sources in standby = %v, want none", on)
+	}
+}
+
+func TestUpGauge(t *testing.T) {
+	a, port := newTestAmp(t)
+	srv := serve(t, a)
+
+	_, body := request(t, srv, "GET", "/metrics", "")
+	if !strings.Contains(body, "cxa81_up 1\n") || strings.Contains(body, "cxa81_last_reply_timestamp_seconds") {
+		t.Errorf("GET /metrics before any reply = %s, want up without a last reply", body)
+	}
+
+	before := time.Now()
+	port.push("#02,01,1")
+	waitFor(t, "the reply", func() bool { return a.lastReplyTime.Load() != 0 })
+	_, body = request(t, srv, "GET", "/metrics", "")
+	_, line, _ := strings.Cut(body, "\ncxa81_last_reply_timestamp_seconds ")
+	line, _, _ = strings.Cut(line, "\n")
+	ts, err := strconv.ParseFloat(line, 64)
+	if err != nil || ts < float64(before.Unix()) || ts > float64(time.Now().Unix()+1) {
+		t.Errorf("Last reply timestamp %q, want the time of the reply", line)
+	}
+
+	port.Close()
+	waitFor(t, "the read error", func() bool { status, _ := a.connection(); return status != connConnected })
+	if _, body = request(t, srv, "GET", "/metrics", ""); !strings.Contains(body, "cxa81_up 0\n") {
+		t.Errorf("GET /metrics disconnected = %s, want down", body)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// withCORS sets the CORS headers for the given origin, which may be "*", and
+// answers preflight requests.
+func withCORS(origin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		switch {
+		case origin == "*":
+			h.Set("Access-Control-Allow-Origin", "*")
+		case r.Header.Get("Origin") == origin:
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isMutating reports whether the request may send commands to the amplifier.
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// withRateLimit rejects mutating requests exceeding the limiter with a 429,
+// read-only requests aren't limited.
+func withRateLimit(limiter *rate.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res := limiter.Reserve()
+		if delay := res.Delay(); !res.OK() || delay > 0 {
+			res.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeError(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// publicPaths are served without auth, for the health checks and metrics
+// scrapers, also under the /amp/{name} prefix of each amplifier.
+var publicPaths = []string{"/healthz", "/metrics"}
+
+// isPublic reports whether the request is for one of publicPaths.
+func isPublic(r *http.Request) bool {
+	path := r.URL.Path
+	if rest, ok := strings.CutPrefix(path, "/amp/"); ok {
+		_, path, _ = strings.Cut(rest, "/")
+		path = "/" + path
+	}
+	return slices.Contains(publicPaths, path)
+}
+
+// withBasicAuth rejects requests without the given HTTP Basic Auth
+// credentials with a 401, except for publicPaths.
+func withBasicAuth(user, pwd string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, p, ok := r.BasicAuth()
+		// Compare both so the time doesn't tell which one is wrong.
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		pwdOK := subtle.ConstantTimeCompare([]byte(p), []byte(pwd)) == 1
+		if !ok || !userOK || !pwdOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cxa81", charset="UTF-8"`)
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCooldown rejects the mutating requests of a user within interval of
+// their previous one with a 429. With perUser, users are told apart by their
+// Basic Auth username, which must then be checked beforehand, otherwise all
+// the requests share a single cooldown. The time is read from clock.
+func withCooldown(clock Clock, interval time.Duration, perUser bool, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	last := make(map[string]time.Time)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var user string
+		if perUser {
+			user, _, _ = r.BasicAuth()
+		}
+		now := clock.Now()
+		mu.Lock()
+		// Forget the users whose cooldown is over.
+		for u, t := range last {
+			if now.Sub(t) >= interval {
+				delete(last, u)
+			}
+		}
+		wait := interval - now.Sub(last[user])
+		if wait <= 0 {
+			last[user] = now
+		}
+		mu.Unlock()
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, "Too many requests, wait for the cooldown", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withMaxBody rejects mutating requests with a body over limit bytes with a
+// 413. The body is read before calling next, so the handlers' decoding errors
+// can't be mistaken for it.
+func withMaxBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, fmt.Sprintf("Request body over %d bytes", limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// okHandler replies 200 to every request.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		allowed, origin, method string
+		wantCode                int
+		wantOrigin              string
+	}{
+		{"https://ui.example", "https://ui.example", "OPTIONS", 204, "https://ui.example"},
+		{"https://ui.example", "https://ui.example", "POST", 200, "https://ui.example"},
+		{"https://ui.example", "https://evil.example", "POST", 200, ""},
+		{"*", "https://any.example", "OPTIONS", 204, "*"},
+		{"*", "https://any.example", "GET", 200, "*"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/status", nil)
+		r.Header.Set("Origin", tt.origin)
+		w := httptest.NewRecorder()
+		withCORS(tt.allowed, okHandler).ServeHTTP(w, r)
+
+		if w.Code != tt.wantCode || w.Header().Get("Access-Control-Allow-Origin") != tt.wantOrigin {
+			t.Errorf("%s from %s allowing %s = %d with origin %q, want %d with %q", tt.method, tt.origin, tt.allowed, w.Code, w.Header().Get("Access-Control-Allow-Origin"), tt.wantCode, tt.wantOrigin)
+		}
+		if tt.wantOrigin != "" && w.Header().Get("Access-Control-Allow-Methods") == "" {
+			t.Errorf("%s from %s: no allowed methods", tt.method, tt.origin)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := withRateLimit(rate.NewLimiter(rate.Limit(1), 3), okHandler)
+
+	for i := range 3 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/status", nil))
+		if w.Code != 200 {
+			t.Errorf("Request %d of the burst = %d, want 200", i+1, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/status", nil))
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Request over the burst = %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Read-only requests aren't limited.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != 200 {
+		t.Errorf("GET over the burst = %d, want 200", w.Code)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	// post sends a POST as the user, anonymous if empty, returning the code.
+	post := func(h http.Handler, user string) int {
+		r := httptest.NewRequest("POST", "/status", nil)
+		if user != "" {
+			r.SetBasicAuth(user, "secret")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	clock := NewFakeClock(time.Now())
+	h := withCooldown(clock, time.Hour, true, okHandler)
+	for _, tt := range []struct {
+		user string
+		want int
+	}{{"alice", 200}, {"alice", 429}, {"bob", 200}, {"bob", 429}, {"", 200}, {"", 429}, {"alice", 429}} {
+		if got := post(h, tt.user); got != tt.want {
+			t.Errorf("POST as %q = %d, want %d", tt.user, got, tt.want)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != 200 {
+		t.Errorf("GET in the cooldown = %d, want 200", w.Code)
+	}
+
+	// Without per-user cooldowns every request shares one.
+	h = withCooldown(clock, time.Hour, false, okHandler)
+	if got := post(h, "alice"); got != 200 {
+		t.Errorf("Shared POST as alice = %d, want 200", got)
+	}
+	if got := post(h, "bob"); got != 429 {
+		t.Errorf("Shared POST as bob = %d, want 429", got)
+	}
+
+	// Users can send again once their cooldown is over.
+	h = withCooldown(clock, time.Minute, true, okHandler)
+	post(h, "alice")
+	clock.Advance(59 * time.Second)
+	if got := post(h, "alice"); got != 429 {
+		t.Errorf("POST within the cooldown = %d, want 429", got)
+	}
+	clock.Advance(time.Second)
+	if got := post(h, "alice"); got != 200 {
+		t.Errorf("POST after the cooldown = %d, want 200", got)
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	// The handler echoes the body, checking it's passed on whole.
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.Copy(w, r.Body) })
+	h := withMaxBody(16, echo)
+
+	for _, tt := range []struct {
+		method, body string
+		want         int
+	}{
+		{"POST", `{"mute": "on"}`, 200},
+		{"POST", strings.Repeat("x", 16), 200},
+		{"POST", strings.Repeat("x", 17), 413},
+		{"PUT", strings.Repeat("x", 4096), 413},
+		{"GET", strings.Repeat("x", 4096), 200},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, "/status", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s %d bytes = %d, want %d", tt.method, len(tt.body), w.Code, tt.want)
+		}
+		if w.Code == 200 && tt.method != "GET" && w.Body.String() != tt.body {
+			t.Errorf("%s %d bytes passed on %q, want the body", tt.method, len(tt.body), w.Body)
+		}
+	}
+}
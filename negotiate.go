@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptQuality returns the quality the Accept header gives the media type,
+// from its most specific matching range. Without the header anything is
+// accepted.
+func acceptQuality(accept, mediaType string) float64 {
+	if accept == "" {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, rng := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+		if err != nil {
+			continue
+		}
+		var s int
+		switch t {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+// wantsText reports whether the client prefers text/plain to JSON, JSON is
+// the default when they are equally acceptable.
+func wantsText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/plain") > acceptQuality(accept, "application/json")
+}
+
+// serveField replies with a single state field, as a JSON object or as the
+// bare value for text/plain, e.g. D2 for the source.
+func (a *Amplifier) serveField(name string, value func(AmplifierState) any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := value(a.State())
+		w.Header().Add("Vary", "Accept")
+		if wantsText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, v)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{name: v})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		text   bool
+	}{
+		{"", false},
+		{"text/plain", true},
+		{"application/json", false},
+		{"*/*", false},
+		{"text/*", true},
+		{"text/plain;q=0.5, application/json", false},
+		{"text/plain, application/json;q=0.9", true},
+		{"text/plain;q=0.1, */*;q=0", true},
+		{"application/*, text/plain;q=bad", false},
+	} {
+		r, _ := http.NewRequest("GET", "/source", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsText(r); got != tt.text {
+			t.Errorf("wantsText(%q) = %v, want %v", tt.accept, got, tt.text)
+		}
+	}
+}
+
+func TestServeFieldNegotiation(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	for _, tt := range []struct {
+		path, accept string
+		want, ct     string
+	}{
+		{"/source", "text/plain", "D1\n", "text/plain"},
+		{"/source", "application/json", "{\"source\":\"D1\"}\n", "application/json"},
+		{"/source", "", "{\"source\":\"D1\"}\n", "application/json"},
+		{"/power", "text/plain", "true\n", "text/plain"},
+		{"/power", "application/json", "{\"power\":true}\n", "application/json"},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(strings.Builder)
+		_, err = io.Copy(buf, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want || !strings.HasPrefix(resp.Header.Get("Content-Type"), tt.ct) || resp.Header.Get("Vary") != "Accept" {
+			t.Errorf("GET %s with Accept %q = %q, %s, want %q, %s", tt.path, tt.accept, buf, resp.Header.Get("Content-Type"), tt.want, tt.ct)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI description of the HTTP API.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// serveOpenAPI replies with the OpenAPI description.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
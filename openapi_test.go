@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	a := NewAmplifierWithPort(newFakePort())
+	w := httptest.NewRecorder()
+	serveOpenAPI(w, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	var spec struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Invalid OpenAPI JSON: %v", err)
+	}
+	if spec.OpenAPI == "" {
+		t.Error("No OpenAPI version")
+	}
+
+	for _, path := range []string{"/status", "/healthz", "/api/sources", "/batch", "/macro/{name}", "/source/{name}/trim"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("Path %s missing from the spec", path)
+		}
+	}
+	// Every documented operation is served.
+	mux := a.routes(true, false)
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			r := httptest.NewRequest(strings.ToUpper(method), strings.ReplaceAll(path, "{name}", "d1"), nil)
+			if _, pattern := mux.Handler(r); pattern == "" {
+				t.Errorf("%s %s documented but not served", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// jittered returns d randomly spread by up to the given fraction either way,
+// so that instances sharing an interval don't stay in step.
+func jittered(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// Poll queries the state every pollInterval until ctx is done, catching
+// changes the amplifier didn't report.
+func (a *Amplifier) Poll(ctx context.Context) {
+	for a.sleepContext(ctx, jittered(a.pollInterval, a.jitter)) == nil {
+		if err := a.QueryState(ctx); err != nil {
+			log.Printf("error, polling state: %v", err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJittered(t *testing.T) {
+	const d = 10 * time.Second
+	var spread bool
+	for range 1000 {
+		got := jittered(d, 0.2)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("jittered(%v, 0.2) = %v, want within 20%%", d, got)
+		}
+		spread = spread || got != d
+	}
+	if !spread {
+		t.Error("jittered never varied the interval")
+	}
+	if got := jittered(d, 0); got != d {
+		t.Errorf("jittered(%v, 0) = %v, want unchanged", d, got)
+	}
+}
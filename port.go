@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// PortOpener opens the named serial port.
+type PortOpener func(name string, mode *serial.Mode) (serial.Port, error)
+
+// openPort is the PortOpener used by NewAmplifier.
+var openPort PortOpener = serial.Open
+
+// portErrorCode returns the serial error code matching err, if any.
+func portErrorCode(err error) (serial.PortErrorCode, bool) {
+	var pe *serial.PortError
+	switch {
+	case errors.As(err, &pe):
+		return pe.Code(), true
+	case errors.Is(err, fs.ErrNotExist):
+		return serial.PortNotFound, true
+	case errors.Is(err, fs.ErrPermission):
+		return serial.PermissionDenied, true
+	}
+	return 0, false
+}
+
+// openPortRetry opens the port, retrying up to attempts times every interval
+// while it doesn't exist or is busy, e.g. while the USB adapter is plugged in.
+func openPortRetry(name string, mode *serial.Mode, attempts int, interval time.Duration) (serial.Port, error) {
+	for attempt := 1; ; attempt++ {
+		port, err := openPort(name, mode)
+		if err == nil {
+			return port, nil
+		}
+
+		code, ok := portErrorCode(err)
+		if !ok {
+			return nil, err
+		}
+		switch code {
+		case serial.PermissionDenied:
+			return nil, fmt.Errorf("Permission denied opening %s, add your user to the dialout group (e.g. sudo usermod -aG dialout $USER) and log in again: %w", name, err)
+		case serial.PortNotFound, serial.PortBusy:
+			if attempt >= attempts {
+				if code == serial.PortNotFound {
+					return nil, fmt.Errorf("Serial port %s not found, check the adapter is plugged in and -port is correct: %w", name, err)
+				}
+				return nil, fmt.Errorf("Serial port %s is busy, check no other program is using it: %w", name, err)
+			}
+		default:
+			return nil, err
+		}
+
+		log.Printf("error, opening %s (attempt %d/%d): %v, retrying in %v", name, attempt, attempts, err, interval)
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+func TestOpenPortRetry(t *testing.T) {
+	tests := []struct {
+		errs     []error
+		attempts int
+		calls    int
+		want     string
+	}{
+		{errs: []error{fs.ErrNotExist, fs.ErrNotExist}, attempts: 3, calls: 3},
+		{errs: []error{fs.ErrNotExist, fs.ErrNotExist}, attempts: 2, calls: 2, want: "not found"},
+		{errs: []error{fs.ErrPermission}, attempts: 3, calls: 1, want: "dialout"},
+		{errs: []error{fmt.Errorf("Unexpected")}, attempts: 3, calls: 1, want: "Unexpected"},
+	}
+	for _, tt := range tests {
+		var calls int
+		stubOpenPort(t, func(name string, mode *serial.Mode) (serial.Port, error) {
+			calls++
+			if calls <= len(tt.errs) {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: tt.errs[calls-1]}
+			}
+			return fakeSerial{newFakePort()}, nil
+		})
+
+		port, err := openPortRetry("/dev/ttyUSB0", serialMode, tt.attempts, 0)
+		if calls != tt.calls {
+			t.Errorf("%v: %d attempts, want %d", tt.errs, calls, tt.calls)
+		}
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%v: %v, want the port opened", tt.errs, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%v: %v, want an error with %q", tt.errs, err, tt.want)
+		case port != nil:
+			port.Close()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// refreshCall is a refresh in progress, shared by concurrent callers.
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Refresh queries the amplifier state again with QueryAll and waits for the
+// replies, a refresh already in progress is waited for instead of sending the
+// queries twice.
+func (a *Amplifier) Refresh(ctx context.Context) error {
+	a.refreshMu.Lock()
+	call := a.refreshing
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		a.refreshing = call
+		go func() {
+			_, call.err = a.QueryAll(context.Background())
+			a.refreshMu.Lock()
+			a.refreshing = nil
+			a.refreshMu.Unlock()
+			close(call.done)
+		}()
+	}
+	a.refreshMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queryRetryInitial is the delay before retrying rejected state queries, it
+// doubles on each retry.
+const queryRetryInitial = 250 * time.Millisecond
+
+// QueryAll sends the state, version and, with extendedQueries, identity
+// queries one at a time, waiting up to confirmTimeout for the reply to each of
+// them. Queries the amplifier rejects as
+// not available, e.g. while it's still waking, are retried with a backoff for
+// up to queryRetryDeadline, except those only available when on while it's
+// in standby. Other rejections, e.g. an unknown command, aren't retried. It
+// returns the state, filled in as far as the replies went with an
+// *ErrStateIncomplete when some are missing.
+func (a *Amplifier) QueryAll(ctx context.Context) (AmplifierState, error) {
+	queries := slices.Concat(a.stateQueries(), []Command{GetProtocolVersion, GetFirmwareVersion})
+	if a.extendedQueries {
+		queries = append(queries, GetModel, GetSerialNumber)
+	}
+	deadline := a.clock.Now().Add(a.queryRetryDeadline)
+
+	// failed are the queries rejected for good.
+	var failed []Command
+	for delay := queryRetryInitial; ; delay *= 2 {
+		rejected, invalid, err := a.queryOnce(ctx, queries)
+		if err != nil {
+			var incomplete *ErrStateIncomplete
+			if errors.As(err, &incomplete) {
+				incomplete.Rejected = slices.Concat(failed, incomplete.Rejected)
+			}
+			return a.State(), err
+		}
+		failed = append(failed, invalid...)
+		// Queries needing power are expected to be rejected in standby.
+		if st := a.State(); !st.Power {
+			rejected = slices.DeleteFunc(rejected, needsPower)
+		}
+		if len(rejected) == 0 || a.clock.Now().Add(delay).After(deadline) {
+			if rejected = slices.Concat(failed, rejected); len(rejected) > 0 {
+				return a.State(), &ErrStateIncomplete{Rejected: rejected}
+			}
+			return a.State(), nil
+		}
+
+		log.Printf("warning, state queries %s rejected, retrying in %v", commandCodes(rejected), delay)
+		if err := a.sleepContext(ctx, delay); err != nil {
+			return a.State(), err
+		}
+		queries = rejected
+	}
+}
+
+// queryOnce sends the queries one at a time, under cmdMu, each waiting for
+// its reply until confirmTimeout, returning those the amplifier rejected as
+// not available, to be retried, and those it rejected otherwise. An error
+// reply carries no command code, so it's only known to answer a query when
+// nothing else awaits one.
+func (a *Amplifier) queryOnce(ctx context.Context, queries []Command) (rejected, invalid []Command, err error) {
+	a.cmdMu.Lock()
+	defer a.cmdMu.Unlock()
+
+	replies, cancel := a.watchReplies()
+	defer cancel()
+
+	var missing []Command
+	for _, c := range queries {
+		if err := a.SendCommandContext(ctx, c); err != nil {
+			return nil, nil, err
+		}
+
+		timeout := a.clock.After(a.confirmTimeout)
+	wait:
+		for {
+			select {
+			case r := <-replies:
+				switch {
+				case confirms(r, c):
+					break wait
+				case r.Group == "00":
+					if rej := (&ErrCommandRejected{Command: c, Reply: *r}); rej.NotAvailable() {
+						rejected = append(rejected, c)
+					} else {
+						invalid = append(invalid, c)
+					}
+					break wait
+				}
+			case <-timeout:
+				missing = append(missing, c)
+				break wait
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return rejected, invalid, &ErrStateIncomplete{Missing: missing, Rejected: slices.Concat(invalid, rejected)}
+	}
+	return rejected, invalid, nil
+}
+
+// serveRefresh refreshes the state and replies with it.
+func (a *Amplifier) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	a.writeRefreshed(w, a.Refresh(r.Context()))
+}
+
+// writeRefreshed replies with the state after a refresh, with a warning when
+// it's incomplete, or with the refresh error.
+func (a *Amplifier) writeRefreshed(w http.ResponseWriter, err error) {
+	var incomplete *ErrStateIncomplete
+	switch {
+	case errors.As(err, &incomplete):
+		// The state is still served, as far as the replies went.
+		w.Header().Set("Warning", fmt.Sprintf("199 - %q", err.Error()))
+	case err != nil:
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	a.writeState(w)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeRefresh(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	// Changed from the front panel, without the amplifier reporting it.
+	port.set(GetSource, "05")
+
+	resp, body := request(t, serve(t, a), "POST", "/refresh", "")
+	if resp.StatusCode != 200 || !strings.Contains(body, `"source":"D2"`) {
+		t.Errorf("POST /refresh = %d %s, want the state on D2", resp.StatusCode, body)
+	}
+	want := slices.Concat(stateQueries, []Command{GetProtocolVersion, GetFirmwareVersion})
+	if got := port.commands(); !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+}
+
+func TestQueryAllQueries(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		a, port := newTestAmp(t, func(a *Amplifier) { a.extendedQueries = extended })
+		port.set(GetMuteState, "1")
+		port.set(GetSource, "05")
+		port.set(GetTemperature, "51")
+
+		st, err := a.QueryAll(context.Background())
+		if err != nil {
+			t.Fatalf("Extended %v: QueryAll: %v", extended, err)
+		}
+		want := slices.Concat(a.stateQueries(), []Command{GetProtocolVersion, GetFirmwareVersion})
+		if extended {
+			want = append(want, GetModel, GetSerialNumber)
+		}
+		sent := port.commands()
+		for _, c := range want {
+			if !slices.Contains(sent, c) {
+				t.Errorf("Extended %v: sent %v, want %v", extended, sent, c)
+			}
+		}
+
+		if !st.Power || !st.Mute || st.Source != "D2" || st.FirmwareVersion != "2.1" {
+			t.Errorf("Extended %v: state %+v, want on and muted on D2 with firmware 2.1", extended, st)
+		}
+		if got := st.Temperature != nil && *st.Temperature == 51; got != extended {
+			t.Errorf("Extended %v: temperature %v, want it queried %v", extended, st.Temperature, extended)
+		}
+		if extended && (st.Model != "CXA81" || st.SerialNumber != "SN123" || st.Protection != "None") {
+			t.Errorf("Extended: state %+v, want the identity and protection", st)
+		}
+	}
+}
+
+func TestQueryAllIncomplete(t *testing.T) {
+	a, port := newTestAmp(t, func(a *Amplifier) { a.confirmTimeout = 20 * time.Millisecond })
+	port.onCommand(func(c Command) []string {
+		if c == GetSource {
+			return nil
+		}
+		port.mu.Lock()
+		defer port.mu.Unlock()
+		return port.emulate(c)
+	})
+
+	st, err := a.QueryAll(context.Background())
+	var incomplete *ErrStateIncomplete
+	if !errors.As(err, &incomplete) || !slices.Equal(incomplete.Missing, []Command{GetSource}) {
+		t.Errorf("QueryAll without a source reply = %v, want the source missing", err)
+	}
+	if !st.Power || st.FirmwareVersion != "2.1" || st.Source != "" {
+		t.Errorf("State = %+v, want everything but the source", st)
+	}
+}
+
+func TestQueryAllRetry(t *testing.T) {
+	// rejectSource rejects the first n source queries as not available, as
+	// while the amplifier is waking.
+	rejectSource := func(port *fakePort, n int) {
+		var rejected int
+		port.onCommand(func(c Command) []string {
+			port.mu.Lock()
+			defer port.mu.Unlock()
+			if c == GetSource && rejected < n {
+				rejected++
+				return []string{"#00,04"}
+			}
+			return port.emulate(c)
+		})
+	}
+	// Already on so that the power reply doesn't query the source again.
+	poweredOn := func(a *Amplifier) {
+		a.state.Power = true
+		a.queryRetryDeadline = time.Second
+	}
+
+	logs := captureLog(t)
+	a, port := newTestAmp(t, poweredOn)
+	rejectSource(port, 1)
+	st, err := a.QueryAll(context.Background())
+	if err != nil || st.Source != "D1" {
+		t.Errorf("QueryAll = %+v, %v, want the source on retry", st, err)
+	}
+	if n := strings.Count(fmt.Sprint(port.commands()), fmt.Sprint(GetSource)); n != 2 {
+		t.Errorf("Sent %v, want the source queried twice", port.commands())
+	}
+	if !strings.Contains(logs.String(), "state queries 03,01 rejected, retrying in 250ms") {
+		t.Errorf("Log %q, want the retry", logs)
+	}
+
+	// Retries stop at the deadline.
+	a, port = newTestAmp(t, poweredOn, func(a *Amplifier) { a.queryRetryDeadline = 100 * time.Millisecond })
+	rejectSource(port, 100)
+	_, err = a.QueryAll(context.Background())
+	var incomplete *ErrStateIncomplete
+	if !errors.As(err, &incomplete) || !slices.Equal(incomplete.Rejected, []Command{GetSource}) {
+		t.Errorf("QueryAll rejected past the deadline = %v, want the source rejected", err)
+	}
+}
+
+func TestQueryAllErrorReply(t *testing.T) {
+	a, port := newTestAmp(t, func(a *Amplifier) { a.confirmTimeout = 20 * time.Millisecond })
+	port.onCommand(func(c Command) []string {
+		port.mu.Lock()
+		defer port.mu.Unlock()
+		switch c {
+		case GetProtocolVersion:
+			return nil
+		case GetFirmwareVersion:
+			return []string{"#00,04"}
+		}
+		return port.emulate(c)
+	})
+
+	// The error reply answers the firmware query, not the unanswered one
+	// before it.
+	_, err := a.QueryAll(context.Background())
+	var incomplete *ErrStateIncomplete
+	if !errors.As(err, &incomplete) ||
+		!slices.Equal(incomplete.Missing, []Command{GetProtocolVersion}) ||
+		!slices.Equal(incomplete.Rejected, []Command{GetFirmwareVersion}) {
+		t.Errorf("QueryAll = %v, want the protocol version missing and the firmware rejected", err)
+	}
+}
+
+func TestQueryAllWaitsForCommands(t *testing.T) {
+	a, port := newTestAmp(t)
+
+	a.cmdMu.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := a.QueryAll(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Sent %v while a command awaited its reply", got)
+	}
+	a.cmdMu.Unlock()
+
+	if err := <-done; err != nil {
+		t.Errorf("QueryAll: %v", err)
+	}
+}
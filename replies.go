@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// replyHandler describes a reply and applies it to the amplifier state.
+type replyHandler struct {
+	// desc describes the reply, and decode its data if not nil.
+	desc   string
+	decode func(data string) string
+
+	// update applies the reply to the state with a.mu held, prev is the
+	// state before the reply. It's nil for replies not changing the state,
+	// e.g. errors.
+	update func(a *Amplifier, r *Reply, prev AmplifierState)
+}
+
+// replyHandlers are the handlers by reply group and number, set in init as
+// the handlers refer back to it through UpdateState.
+var replyHandlers map[[2]string]replyHandler
+
+func init() {
+	replyHandlers = map[[2]string]replyHandler{
+		{"00", "01"}: {desc: "Command group unknown"},
+		{"00", "02"}: {desc: "Command number unknown"},
+		{"00", "03"}: {desc: "Command data error"},
+		{"00", "04"}: {desc: "Command not available"},
+
+		{"02", "01"}: {desc: "Current power state", decode: decodeWith(powerStates), update: updatePower},
+		{"02", "03"}: {desc: "Current mute state", decode: decodeWith(muteStates), update: updateMute},
+		{"02", "24"}: {desc: "Current speaker output", decode: decodeWith(speakerOutputs), update: updateSpeakerOutput},
+		{"02", "26"}: {desc: "Headphones", decode: decodeWith(connectionStates), update: updateConnected(func(st *AmplifierState) *bool { return &st.HeadphonesConnected })},
+		{"02", "27"}: {desc: "Speakers", decode: decodeWith(connectionStates), update: updateConnected(func(st *AmplifierState) *bool { return &st.SpeakersConnected })},
+		{"02", "28"}: {desc: "Display brightness", update: updateBrightness},
+		{"02", "30"}: {desc: "Auto power down", decode: decodeWith(autoPowerDownStates), update: updateAutoPowerDown},
+		{"02", "32"}: {desc: "Startup volume", update: updateVolume("startupVolume", func(st *AmplifierState) **int { return &st.StartupVolume })},
+		{"02", "34"}: {desc: "Max volume", update: updateVolume("maxVolume", func(st *AmplifierState) **int { return &st.MaxVolume })},
+		{"02", "36"}: {desc: "Protection", decode: decodeWith(protectionStates), update: updateProtection},
+		{"02", "37"}: {desc: "Temperature", decode: func(data string) string { return data + "°C" }, update: updateTemperature},
+
+		{"04", "01"}: {desc: "Current source", decode: decodeWith(sources), update: updateSource},
+		{"04", "05"}: {desc: "Source trim", decode: decodeTrim, update: updateTrim},
+		{"04", "07"}: {desc: "Bluetooth pairing", decode: decodeWith(pairingStates), update: updatePairing},
+
+		{"06", "01"}: {desc: "Current bass", update: updateTone("bass", func(st *AmplifierState) *int { return &st.Bass })},
+		{"06", "03"}: {desc: "Current treble", update: updateTone("treble", func(st *AmplifierState) *int { return &st.Treble })},
+		{"06", "05"}: {desc: "Current balance", update: updateTone("balance", func(st *AmplifierState) *int { return &st.Balance })},
+
+		{"14", "01"}: {desc: "Protocol Version", update: func(a *Amplifier, r *Reply, _ AmplifierState) { a.state.ProtocolVersion = r.Data }},
+		{"14", "02"}: {desc: "Get Firmware Version", update: func(a *Amplifier, r *Reply, _ AmplifierState) { a.state.FirmwareVersion = r.Data }},
+		{"14", "03"}: {desc: "Model", update: func(a *Amplifier, r *Reply, _ AmplifierState) { a.state.Model = r.Data }},
+		{"14", "04"}: {desc: "Serial number", update: func(a *Amplifier, r *Reply, _ AmplifierState) { a.state.SerialNumber = r.Data }},
+	}
+}
+
+// registerReply adds or replaces the handler of the reply group and number,
+// it must be called before the amplifier is started, e.g. from an init
+// function.
+func registerReply(group, number string, h replyHandler) {
+	replyHandlers[[2]string{group, number}] = h
+}
+
+// decodeWith returns a decoder looking the data up in the values, keeping
+// the raw data when it's not one of them.
+func decodeWith(values map[string]string) func(string) string {
+	return func(data string) string {
+		if v, ok := values[data]; ok {
+			return v
+		}
+		return data
+	}
+}
+
+func updatePower(a *Amplifier, r *Reply, prev AmplifierState) {
+	if _, ok := powerStates[r.Data]; !ok {
+		return
+	}
+	a.state.Power = r.Data == "1"
+	a.setKnown("power", true)
+
+	// Powering off resets the muted and source state, unless keepStateOnOff
+	// is set in which case they are kept as last known. Either way they are
+	// queried again once powered on rather than waiting for the amplifier to
+	// report them.
+	if !a.state.Power {
+		if !a.keepStateOnOff {
+			a.state.Mute = false
+			a.state.Source = ""
+		}
+		a.setKnown("mute", false)
+		a.setKnown("source", false)
+		a.stopSleep()
+	} else if !prev.Power {
+		go a.queryWakeState()
+		a.armSleep()
+	}
+}
+
+func updateMute(a *Amplifier, r *Reply, prev AmplifierState) {
+	if _, ok := muteStates[r.Data]; !ok {
+		return
+	}
+	mute := r.Data == "1"
+	if mute && !prev.Mute && a.transientMute() {
+		a.debugf("ignoring the mute while switching sources")
+		return
+	}
+	a.state.Mute = mute
+	a.setKnown("mute", true)
+}
+
+func updateSpeakerOutput(a *Amplifier, r *Reply, _ AmplifierState) {
+	if output, ok := speakerOutputs[r.Data]; ok {
+		a.state.SpeakerOutput = output
+		a.setKnown("speakerOutput", true)
+	}
+}
+
+// updateConnected returns the handler of the headphones or speakers
+// connection state.
+func updateConnected(field func(*AmplifierState) *bool) func(*Amplifier, *Reply, AmplifierState) {
+	return func(a *Amplifier, r *Reply, _ AmplifierState) {
+		if _, ok := connectionStates[r.Data]; ok {
+			*field(&a.state) = r.Data == "1"
+		}
+	}
+}
+
+func updateBrightness(a *Amplifier, r *Reply, _ AmplifierState) {
+	level, err := strconv.Atoi(r.Data)
+	if err != nil || level < minBrightness || level > maxBrightness {
+		log.Printf("error, invalid display brightness: %q", r.Data)
+		return
+	}
+	a.state.DisplayBrightness = &level
+	a.setKnown("displayBrightness", true)
+}
+
+func updateAutoPowerDown(a *Amplifier, r *Reply, _ AmplifierState) {
+	if _, ok := autoPowerDownStates[r.Data]; ok {
+		a.state.AutoPowerDown = r.Data == "1"
+		a.setKnown("autoPowerDown", true)
+	}
+}
+
+// updateVolume returns the handler of the startup or max volume setting,
+// known as the given field.
+func updateVolume(known string, field func(*AmplifierState) **int) func(*Amplifier, *Reply, AmplifierState) {
+	return func(a *Amplifier, r *Reply, _ AmplifierState) {
+		level, err := strconv.Atoi(r.Data)
+		if err != nil || level < minVolume || level > maxVolume {
+			log.Printf("error, invalid volume setting: %q", r.Data)
+			return
+		}
+		*field(&a.state) = &level
+		a.setKnown(known, true)
+	}
+}
+
+func updateProtection(a *Amplifier, r *Reply, prev AmplifierState) {
+	protection, ok := protectionStates[r.Data]
+	if !ok {
+		log.Printf("error, invalid protection status: %q", r.Data)
+		return
+	}
+	if protection != prev.Protection && protectionEngaged(protection) {
+		log.Printf("Amplifier protection engaged: %s", protection)
+	}
+	a.state.Protection = protection
+}
+
+func updateTemperature(a *Amplifier, r *Reply, _ AmplifierState) {
+	temperature, err := strconv.Atoi(r.Data)
+	if err != nil {
+		log.Printf("error, invalid temperature: %q", r.Data)
+		return
+	}
+	a.state.Temperature = &temperature
+}
+
+func updateSource(a *Amplifier, r *Reply, prev AmplifierState) {
+	if source, ok := sources[r.Data]; ok {
+		// Also switched from the front panel or remote.
+		if prev.Source != "" && source != prev.Source {
+			a.sourceSwitchedAt = a.clock.Now()
+		}
+		a.state.Source = source
+		a.setKnown("source", true)
+	}
+}
+
+// decodeTrim returns the trim data as the source and signed level.
+func decodeTrim(data string) string {
+	if source, level, err := parseTrim(data); err == nil {
+		return fmt.Sprintf("%s %+d", source, level)
+	}
+	return data
+}
+
+func updateTrim(a *Amplifier, r *Reply, _ AmplifierState) {
+	source, level, err := parseTrim(r.Data)
+	if err != nil {
+		log.Printf("error, %v", err)
+		return
+	}
+	// Copy the trims as the previous state may be in use outside the lock.
+	trims := make(map[string]int, len(a.state.Trims)+1)
+	for s, l := range a.state.Trims {
+		trims[s] = l
+	}
+	trims[source] = level
+	a.state.Trims = trims
+	a.setKnown(trimKnown(source), true)
+}
+
+func updatePairing(a *Amplifier, r *Reply, _ AmplifierState) {
+	if _, ok := pairingStates[r.Data]; ok {
+		a.state.BluetoothPairing = r.Data == "1"
+	}
+}
+
+// updateTone returns the handler of the bass, treble or balance level, known
+// as the given field.
+func updateTone(known string, field func(*AmplifierState) *int) func(*Amplifier, *Reply, AmplifierState) {
+	return func(a *Amplifier, r *Reply, _ AmplifierState) {
+		level, err := strconv.Atoi(r.Data)
+		if err != nil {
+			log.Printf("error, invalid tone level: %q", r.Data)
+			return
+		}
+		*field(&a.state) = level
+		a.setKnown(known, true)
+	}
+}
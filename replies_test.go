@@ -0,0 +1,49 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestRegisterReply(t *testing.T) {
+	orig := maps.Clone(replyHandlers)
+	t.Cleanup(func() { replyHandlers = orig })
+
+	var got []*Reply
+	registerReply("99", "01", replyHandler{
+		desc:   "Custom",
+		decode: func(data string) string { return "decoded " + data },
+		update: func(a *Amplifier, r *Reply, _ AmplifierState) {
+			got = append(got, r)
+			a.state.ProtocolVersion = r.Data
+		},
+	})
+	// Registering replaces the built in handlers too.
+	var muted int
+	registerReply("02", "03", replyHandler{desc: "Muted", update: func(*Amplifier, *Reply, AmplifierState) { muted++ }})
+
+	a := NewAmplifierWithPort(newFakePort())
+	port := a.port.(*fakePort)
+	port.push("#99,01,7", "#99,02,7", "#02,03,1")
+	for range 3 {
+		if err := a.readUpdate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(got) != 1 || got[0].Data != "7" {
+		t.Errorf("Custom handler called with %v, want the 99,01 reply once", got)
+	}
+	if st := a.State(); st.ProtocolVersion != "7" || st.Mute {
+		t.Errorf("State = %+v, want the custom updates only", st)
+	}
+	if muted != 1 {
+		t.Errorf("Replaced mute handler called %d times, want 1", muted)
+	}
+	if s := (&Reply{Group: "99", Number: "01", Data: "7"}).String(); s != "Custom: decoded 7" {
+		t.Errorf("String() = %q, want the custom description", s)
+	}
+	if s := (&Reply{Group: "99", Number: "02", Data: "7"}).String(); s != "Unknown reply: 99,02,7" {
+		t.Errorf("String() = %q, want an unknown reply", s)
+	}
+}
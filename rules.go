@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// errForbidden is returned for changes denied by the configuration.
+var errForbidden = errors.New("Forbidden by the configuration")
+
+// ruleValues are the values accepted in rules by category, nil for
+// categories only allowed or denied as a whole.
+var ruleValues = map[string][]string{
+	"power":     {"on", "off"},
+	"mute":      {"on", "off"},
+	"source":    nil, // Checked with lookupSource
+	"speakers":  {"a", "b", "ab"},
+	"bass":      nil,
+	"treble":    nil,
+	"balance":   nil,
+	"trim":      nil,
+	"bluetooth": nil,
+	"display":   nil,
+	"apd":       {"on", "off"},
+	"volume":    nil,
+	"raw":       nil,
+}
+
+// commandRules are the allowed and denied changes, as category or
+// category:value strings. A category with allow rules only permits the
+// values they list, other categories are allowed unless denied.
+type commandRules struct {
+	allow []string
+	deny  []string
+}
+
+// parseRule normalizes a category or category:value rule.
+func parseRule(rule string) (string, error) {
+	category, value, hasValue := strings.Cut(strings.ToLower(strings.TrimSpace(rule)), ":")
+	values, ok := ruleValues[category]
+	if !ok {
+		return "", fmt.Errorf("Unknown command category in rule %q", rule)
+	}
+	if !hasValue {
+		return category, nil
+	}
+
+	switch {
+	case category == "source":
+		src, ok := lookupSource(value)
+		if !ok {
+			return "", fmt.Errorf("Unknown source in rule %q", rule)
+		}
+		value = strings.ToLower(src.Name)
+	case values == nil:
+		return "", fmt.Errorf("Invalid rule %q, %s can't have a value", rule, category)
+	case !slices.Contains(values, value):
+		return "", fmt.Errorf("Invalid value in rule %q, expected: %s", rule, strings.Join(values, "/"))
+	}
+
+	return category + ":" + value, nil
+}
+
+// parseRules returns the rules from the allow and deny lists.
+func parseRules(allow, deny []string) (commandRules, error) {
+	var rules commandRules
+	for _, r := range allow {
+		rule, err := parseRule(r)
+		if err != nil {
+			return rules, err
+		}
+		rules.allow = append(rules.allow, rule)
+	}
+	for _, r := range deny {
+		rule, err := parseRule(r)
+		if err != nil {
+			return rules, err
+		}
+		rules.deny = append(rules.deny, rule)
+	}
+
+	return rules, nil
+}
+
+// permit returns errForbidden unless the rules allow the change, value may be
+// empty when it isn't known, e.g. when cycling sources.
+func (rules commandRules) permit(category, value string) error {
+	matches := func(rule string) bool {
+		return rule == category || (value != "" && rule == category+":"+strings.ToLower(value))
+	}
+
+	if slices.ContainsFunc(rules.deny, matches) {
+		return fmt.Errorf("%w: %s", errForbidden, describeChange(category, value))
+	}
+	restricted := slices.ContainsFunc(rules.allow, func(rule string) bool {
+		return rule == category || strings.HasPrefix(rule, category+":")
+	})
+	if restricted && !slices.ContainsFunc(rules.allow, matches) {
+		return fmt.Errorf("%w: %s", errForbidden, describeChange(category, value))
+	}
+
+	return nil
+}
+
+// describeChange returns the change for error messages.
+func describeChange(category, value string) string {
+	if value == "" {
+		return category
+	}
+	return category + " " + value
+}
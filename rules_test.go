@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules([]string{"Source:BT", "mute"}, []string{" power:OFF "})
+	if err != nil {
+		t.Fatalf("parseRules: %v", err)
+	}
+	if want := []string{"source:bluetooth", "mute"}; !slices.Equal(rules.allow, want) {
+		t.Errorf("Allow = %v, want %v", rules.allow, want)
+	}
+	if want := []string{"power:off"}; !slices.Equal(rules.deny, want) {
+		t.Errorf("Deny = %v, want %v", rules.deny, want)
+	}
+
+	for _, rule := range []string{"volume:up", "power:maybe", "source:nope", "coffee"} {
+		if _, err := parseRules(nil, []string{rule}); err == nil {
+			t.Errorf("parseRules(%q) = nil error, want invalid", rule)
+		}
+	}
+}
+
+func TestPermit(t *testing.T) {
+	rules, err := parseRules([]string{"source:d1", "source:d2"}, []string{"power:off", "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		category, value string
+		ok              bool
+	}{
+		{"power", "on", true},
+		{"power", "off", false},
+		{"power", "", true},
+		{"mute", "on", true},
+		{"source", "D2", true},
+		{"source", "D3", false},
+		{"source", "", false},
+		{"raw", "", false},
+	} {
+		if err := rules.permit(tt.category, tt.value); (err == nil) != tt.ok || (err != nil && !errors.Is(err, errForbidden)) {
+			t.Errorf("permit(%s, %s) = %v, want ok %v", tt.category, tt.value, err, tt.ok)
+		}
+	}
+	if err := (commandRules{}).permit("power", "off"); err != nil {
+		t.Errorf("Default permit(power, off) = %v, want allowed", err)
+	}
+}
+
+func TestServeRules(t *testing.T) {
+	a, port := newQueriedAmp(t, func(a *Amplifier) {
+		a.rules = commandRules{deny: []string{"power:off"}}
+	})
+	srv := serve(t, a)
+
+	if resp, body := request(t, srv, "POST", "/status", `{"power": "off"}`); resp.StatusCode != 403 {
+		t.Errorf("POST power off = %d %s, want 403", resp.StatusCode, body)
+	}
+	if got := port.commands(); len(got) != 0 {
+		t.Errorf("Denied power off sent %v", got)
+	}
+	if !a.State().Power {
+		t.Error("Denied power off turned the amplifier off")
+	}
+
+	if resp, body := request(t, srv, "POST", "/status", `{"mute": "on", "source": "D2"}`); resp.StatusCode != 200 {
+		t.Errorf("POST mute on, source D2 = %d %s, want 200", resp.StatusCode, body)
+	}
+	if got, want := port.commands(), []Command{SetMuteOn, SetSourceD2}; !slices.Equal(got, want) {
+		t.Errorf("Allowed changes sent %v, want %v", got, want)
+	}
+}
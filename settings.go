@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// serveAutoPowerDown enables or disables the auto power down, replying with
+// the setting confirmed by the amplifier.
+func (a *Amplifier) serveAutoPowerDown(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Enabled == nil {
+		writeError(w, "Missing enabled", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.setAutoPowerDown(r.Context(), *req.Enabled); err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+	}{a.State().AutoPowerDown})
+}
+
+// setAutoPowerDown sends the auto power down setting unless the amplifier
+// already reported it.
+func (a *Amplifier) setAutoPowerDown(ctx context.Context, enabled bool) error {
+	if err := a.rules.permit("apd", powerValue(enabled)); err != nil {
+		return err
+	}
+	if err := a.requirePower(ctx); err != nil {
+		return err
+	}
+	if a.unchanged("autoPowerDown", func(st AmplifierState) bool { return st.AutoPowerDown == enabled }) {
+		return nil
+	}
+
+	return a.sendAndConfirm(ctx, SetAutoPowerDown(enabled))
+}
+
+// levelSetting is a setting read and written as a level, e.g. the display
+// brightness, served by serveLevel.
+type levelSetting struct {
+	// name is used in the errors, e.g. "Display brightness", and field is
+	// the JSON field of the request and reply, e.g. "brightness".
+	name  string
+	field string
+
+	// rule is the control the changes are checked against, see rules.permit.
+	rule  string
+	get   Command
+	set   func(int) (Command, error)
+	level func(AmplifierState) *int
+
+	// known is the state field confirmed by the replies, see unchanged.
+	known string
+
+	// check rejects a level the current state doesn't allow, if not nil.
+	check func(level int, st AmplifierState) error
+
+	// extra are added to the reply, e.g. the source of a trim.
+	extra map[string]any
+}
+
+var (
+	startupVolumeSetting = levelSetting{
+		name:  "Startup volume",
+		field: "volume",
+		rule:  "volume",
+		get:   GetStartupVolume,
+		set:   SetStartupVolume,
+		level: func(st AmplifierState) *int { return st.StartupVolume },
+		known: "startupVolume",
+
+		// The startup volume can't be set above a known max volume.
+		check: func(level int, st AmplifierState) error {
+			if st.MaxVolume != nil && level > *st.MaxVolume {
+				return fmt.Errorf("Startup volume %d above the max volume %d", level, *st.MaxVolume)
+			}
+			return nil
+		},
+	}
+	maxVolumeSetting = levelSetting{
+		name:  "Max volume",
+		field: "volume",
+		rule:  "volume",
+		get:   GetMaxVolume,
+		set:   SetMaxVolume,
+		level: func(st AmplifierState) *int { return st.MaxVolume },
+		known: "maxVolume",
+	}
+)
+
+// levelHandler returns the handler serving the setting, see serveLevel.
+func (a *Amplifier) levelHandler(setting levelSetting) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.serveLevel(w, r, setting)
+	})
+}
+
+// serveLevel replies with the setting, after setting it for PUT requests,
+// which may wake the amplifier. Other requests query the setting when it
+// isn't known yet, they never wake the amplifier so it must be on.
+func (a *Amplifier) serveLevel(w http.ResponseWriter, r *http.Request, setting levelSetting) {
+	var c Command
+	if r.Method == http.MethodPut {
+		if err := a.rules.permit(setting.rule, ""); err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		level, err := decodeLevel(r.Body, setting.field)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c, err = setting.set(level); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if setting.check != nil {
+			if err := setting.check(level, a.State()); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := a.requirePower(r.Context()); err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+		if a.unchanged(setting.known, func(st AmplifierState) bool {
+			current := setting.level(st)
+			return current != nil && *current == level
+		}) {
+			c = Command{}
+		}
+	} else if st := a.State(); setting.level(st) == nil {
+		if !st.Power {
+			writeError(w, fmt.Sprintf("%s not known, the amplifier is in standby", setting.name), http.StatusConflict)
+			return
+		}
+		c = setting.get
+	}
+
+	if c != (Command{}) {
+		if err := a.sendAndConfirm(r.Context(), c); err != nil {
+			writeError(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	level := setting.level(a.State())
+	if level == nil {
+		writeError(w, setting.name+" not reported by the amplifier", http.StatusGatewayTimeout)
+		return
+	}
+
+	resp := map[string]any{setting.field: *level}
+	maps.Copy(resp, setting.extra)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decodeLevel decodes a request body holding only the level field, e.g.
+// {"volume": 40}.
+func decodeLevel(body io.Reader, field string) (int, error) {
+	var req map[string]*int
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return 0, err
+	}
+
+	var level *int
+	for name, v := range req {
+		if !strings.EqualFold(name, field) {
+			return 0, fmt.Errorf("json: unknown field %q", name)
+		}
+		level = v
+	}
+	if level == nil {
+		return 0, fmt.Errorf("Missing %s", field)
+	}
+	return *level, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAutoPowerDown(t *testing.T) {
+	if got, want := SetAutoPowerDown(true), (Command{Group: "01", Number: "31", Data: "1"}); got != want {
+		t.Errorf("SetAutoPowerDown(true) = %v, want %v", got, want)
+	}
+	if got, want := SetAutoPowerDown(false), (Command{Group: "01", Number: "31", Data: "0"}); got != want {
+		t.Errorf("SetAutoPowerDown(false) = %v, want %v", got, want)
+	}
+
+	a := NewAmplifierWithPort(newFakePort())
+	for _, tt := range []struct {
+		data string
+		want bool
+	}{{"1", true}, {"x", true}, {"0", false}} {
+		a.UpdateState(&Reply{Group: "02", Number: "30", Data: tt.data})
+		if got := a.State().AutoPowerDown; got != tt.want {
+			t.Errorf("AutoPowerDown after %q = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+	if got := (&Reply{Group: "02", Number: "30", Data: "1"}).String(); !strings.HasPrefix(got, "Auto power down: ") {
+		t.Errorf("String() = %q, want the auto power down", got)
+	}
+}
+
+func TestServeAutoPowerDown(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "PUT", "/settings/auto-power-down", `{"enabled": true}`)
+	if resp.StatusCode != 200 || body != "{\"enabled\":true}\n" {
+		t.Errorf("PUT enabled = %d %s, want enabled", resp.StatusCode, body)
+	}
+	if got := port.commands(); !slices.Equal(got, []Command{SetAutoPowerDown(true)}) {
+		t.Errorf("Sent %v, want %v", got, SetAutoPowerDown(true))
+	}
+	if _, body := request(t, srv, "GET", "/status", ""); !strings.Contains(body, `"autoPowerDown":true`) {
+		t.Errorf("GET /status = %s, want the auto power down", body)
+	}
+
+	for _, body := range []string{`{}`, `{"enabled": "yes"}`, `{"on": true}`} {
+		if resp, out := request(t, srv, "PUT", "/settings/auto-power-down", body); resp.StatusCode != 400 {
+			t.Errorf("PUT %s = %d %s, want 400", body, resp.StatusCode, out)
+		}
+	}
+}
+
+func TestVolumeSettings(t *testing.T) {
+	for _, tt := range []struct {
+		set    func(int) (Command, error)
+		number string
+	}{{SetStartupVolume, "33"}, {SetMaxVolume, "35"}} {
+		for _, level := range []int{minVolume, 45, maxVolume} {
+			c, err := tt.set(level)
+			if want := (Command{Group: "01", Number: tt.number, Data: strconv.Itoa(level)}); err != nil || c != want {
+				t.Errorf("Set %s to %d = %v, %v, want %v", tt.number, level, c, err, want)
+			}
+		}
+		for _, level := range []int{minVolume - 1, maxVolume + 1} {
+			if _, err := tt.set(level); err == nil {
+				t.Errorf("Set %s to %d = nil error, want out of range", tt.number, level)
+			}
+		}
+	}
+
+	a := NewAmplifierWithPort(newFakePort())
+	a.UpdateState(&Reply{Group: "02", Number: "32", Data: "25"})
+	a.UpdateState(&Reply{Group: "02", Number: "34", Data: "70"})
+	a.UpdateState(&Reply{Group: "02", Number: "34", Data: "101"})
+	st := a.State()
+	if st.StartupVolume == nil || *st.StartupVolume != 25 || st.MaxVolume == nil || *st.MaxVolume != 70 {
+		t.Errorf("Volumes = %v, %v, want 25 and 70", st.StartupVolume, st.MaxVolume)
+	}
+}
+
+func TestServeVolumeSettings(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	if resp, body := request(t, srv, "PUT", "/settings/max-volume", `{"volume": 60}`); resp.StatusCode != 200 || body != "{\"volume\":60}\n" {
+		t.Errorf("PUT max volume 60 = %d %s", resp.StatusCode, body)
+	}
+	// The startup volume can't be above the max volume.
+	if resp, body := request(t, srv, "PUT", "/settings/startup-volume", `{"volume": 70}`); resp.StatusCode != 400 {
+		t.Errorf("PUT startup volume above the max = %d %s, want 400", resp.StatusCode, body)
+	}
+	if resp, body := request(t, srv, "PUT", "/settings/startup-volume", `{"volume": 40}`); resp.StatusCode != 200 || body != "{\"volume\":40}\n" {
+		t.Errorf("PUT startup volume 40 = %d %s", resp.StatusCode, body)
+	}
+	if resp, body := request(t, srv, "PUT", "/settings/max-volume", `{"volume": 101}`); resp.StatusCode != 400 {
+		t.Errorf("PUT max volume 101 = %d %s, want 400", resp.StatusCode, body)
+	}
+	want := []Command{{Group: "01", Number: "35", Data: "60"}, {Group: "01", Number: "33", Data: "40"}}
+	if got := port.commands(); !slices.Equal(got, want) {
+		t.Errorf("Sent %v, want %v", got, want)
+	}
+}
+
+func TestServeLevelUnchanged(t *testing.T) {
+	for _, always := range []bool{false, true} {
+		a, port := newQueriedAmp(t, func(a *Amplifier) { a.alwaysSend = always })
+		srv := serve(t, a)
+		request(t, srv, "PUT", "/settings/max-volume", `{"volume": 60}`)
+		port.reset()
+
+		// The amplifier already confirmed the level.
+		resp, body := request(t, srv, "PUT", "/settings/max-volume", `{"volume": 60}`)
+		if resp.StatusCode != 200 || body != "{\"volume\":60}\n" {
+			t.Errorf("Always send %v: PUT the same max volume = %d %s", always, resp.StatusCode, body)
+		}
+		if got := len(port.commands()) > 0; got != always {
+			t.Errorf("Always send %v: sent %v for an unchanged level", always, port.commands())
+		}
+	}
+}
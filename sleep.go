@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// armSleep (re)starts the sleep timer, putting the amplifier in standby after
+// sleepIdle without commands.
+func (a *Amplifier) armSleep() {
+	a.sleepMu.Lock()
+	defer a.sleepMu.Unlock()
+
+	if a.sleepTimer != nil {
+		a.sleepTimer.Stop()
+		a.sleepTimer = nil
+	}
+	if a.sleepIdle <= 0 {
+		return
+	}
+
+	a.sleepAt = a.clock.Now().Add(a.sleepIdle)
+	a.sleepTimer = a.clock.AfterFunc(a.sleepIdle, a.sleep)
+}
+
+// stopSleep cancels the sleep timer.
+func (a *Amplifier) stopSleep() {
+	a.sleepMu.Lock()
+	defer a.sleepMu.Unlock()
+
+	if a.sleepTimer != nil {
+		a.sleepTimer.Stop()
+		a.sleepTimer = nil
+	}
+}
+
+// sleep puts the amplifier in standby if it's on.
+func (a *Amplifier) sleep() {
+	if !a.State().Power {
+		return
+	}
+
+	a.sleepMu.Lock()
+	idle := a.sleepIdle
+	a.sleepMu.Unlock()
+
+	log.Printf("Sleep timer, powering off after %v idle", idle)
+	if err := a.sendAndConfirm(context.Background(), SetPowerStandby); err != nil {
+		log.Printf("error, sleep timer: %v", err)
+	}
+}
+
+// serveSleep sets the sleep timer to the minutes query parameter, 0 cancels
+// it. The minutes replace the -auto-off idle period until restart, so the
+// timer is armed again with them after each command rather than reverting.
+func (a *Amplifier) serveSleep(w http.ResponseWriter, r *http.Request) {
+	minutes, err := strconv.Atoi(r.URL.Query().Get("minutes"))
+	if err != nil || minutes < 0 {
+		writeError(w, "Invalid minutes, expected a positive number", http.StatusBadRequest)
+		return
+	}
+
+	if minutes > 0 {
+		if err := a.rules.permit("power", "off"); err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if !a.State().Power && minutes > 0 {
+		writeError(w, errStandby.Error(), http.StatusConflict)
+		return
+	}
+
+	a.sleepMu.Lock()
+	a.sleepIdle = time.Duration(minutes) * time.Minute
+	a.sleepMu.Unlock()
+	a.armSleep()
+
+	var resp struct {
+		SleepAt *time.Time `json:"sleepAt,omitempty"`
+	}
+	if minutes > 0 {
+		a.sleepMu.Lock()
+		at := a.sleepAt.UTC().Truncate(time.Second)
+		a.sleepMu.Unlock()
+		resp.SleepAt = &at
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSleepTimer(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	a, port := newQueriedAmp(t, func(a *Amplifier) {
+		a.clock = clock
+		a.sleepIdle = 10 * time.Minute
+	})
+
+	clock.Advance(9 * time.Minute)
+	if err := a.handleMute(context.Background(), "on"); err != nil {
+		t.Fatal(err)
+	}
+	// The command restarted the timer.
+	clock.Advance(9 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if !a.State().Power {
+		t.Fatal("Powered off within the idle time since the last command")
+	}
+
+	clock.Advance(time.Minute)
+	waitFor(t, "the sleep timer", func() bool { return !a.State().Power })
+	if got := port.commands(); got[len(got)-1] != SetPowerStandby {
+		t.Errorf("Sent %v, want the standby last", got)
+	}
+}
+
+func TestServeSleep(t *testing.T) {
+	a, _ := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "POST", "/sleep?minutes=30", "")
+	if resp.StatusCode != 200 || !strings.Contains(body, "sleepAt") {
+		t.Errorf("POST /sleep?minutes=30 = %d %s, want the sleep time", resp.StatusCode, body)
+	}
+	resp, body = request(t, srv, "POST", "/sleep?minutes=0", "")
+	if resp.StatusCode != 200 || strings.Contains(body, "sleepAt") {
+		t.Errorf("POST /sleep?minutes=0 = %d %s, want the timer cancelled", resp.StatusCode, body)
+	}
+	resp, _ = request(t, srv, "POST", "/sleep?minutes=-1", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("POST /sleep?minutes=-1 = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestServeSleepReplacesAutoOff(t *testing.T) {
+	logs := captureLog(t)
+	clock := NewFakeClock(time.Now())
+	a, _ := newQueriedAmp(t, func(a *Amplifier) {
+		a.clock = clock
+		a.sleepIdle = 10 * time.Minute
+	})
+	request(t, serve(t, a), "POST", "/sleep?minutes=30", "")
+
+	// Later commands arm the timer again with the requested minutes.
+	if err := a.handleMute(context.Background(), "on"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if !a.State().Power {
+		t.Fatal("Powered off after the -auto-off idle time")
+	}
+
+	clock.Advance(20 * time.Minute)
+	waitFor(t, "the sleep timer", func() bool { return !a.State().Power })
+	if !strings.Contains(logs.String(), "powering off after 30m0s idle") {
+		t.Errorf("Log %q, want the requested idle time", logs)
+	}
+}
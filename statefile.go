@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stateFileRefreshTimeout bounds the last state refresh before saving it.
+const stateFileRefreshTimeout = 2 * time.Second
+
+// loadState reads the state saved at path.
+func loadState(path string) (AmplifierState, error) {
+	var st AmplifierState
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(buf, &st)
+	return st, err
+}
+
+// saveState writes the state to path, replacing it atomically so a crash
+// can't leave a truncated file.
+func saveState(path string, st AmplifierState) error {
+	buf, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// stateFileFor returns the state file of the named amplifier, the name is
+// added before the extension so several amplifiers don't share a file.
+func stateFileFor(path, name string) string {
+	if path == "" || name == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// SaveState queries the state one last time and saves it to the state file.
+func (a *Amplifier) SaveState() error {
+	if a.stateFile == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stateFileRefreshTimeout)
+	defer cancel()
+	var incomplete *ErrStateIncomplete
+	if err := a.Refresh(ctx); errors.As(err, &incomplete) {
+		log.Printf("warning, saving the last known state: %v", err)
+	} else if err != nil {
+		return err
+	}
+
+	return saveState(a.stateFile, a.State())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	want := AmplifierState{Power: true, Source: "D2", Bass: 3, Trims: map[string]int{"D2": -2}}
+	if err := saveState(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadState(path)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("loadState = %+v, %v, want %+v", got, err, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"power": tru`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(path); err == nil {
+		t.Error("loadState of a corrupt file succeeded")
+	}
+
+	// A corrupt file doesn't prevent starting.
+	stubOpenPort(t, fakeOpener)
+	cfg := testConfig("/dev/ttyFAKE")
+	cfg.StateFile = path
+	a, err := NewAmplifier(cfg)
+	if err != nil {
+		t.Fatalf("NewAmplifier with a corrupt state file: %v", err)
+	}
+	a.Close()
+}
+
+func TestSaveState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	a, port := newQueriedAmp(t, func(a *Amplifier) { a.stateFile = path })
+	// Changed since the last query, SaveState saves the live state.
+	port.set(GetSource, "05")
+
+	if err := a.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := loadState(path)
+	if err != nil || st.Source != "D2" || !st.Power {
+		t.Errorf("Saved state %+v, %v, want on D2", st, err)
+	}
+	if stateFileFor(path, "office") != filepath.Join(filepath.Dir(path), "state-office.json") {
+		t.Errorf("stateFileFor = %s", stateFileFor(path, "office"))
+	}
+}
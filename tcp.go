@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// tcpPrefix selects a serial to network bridge, e.g. ser2net, as the port.
+const tcpPrefix = "tcp://"
+
+// tcpDialTimeout is how long to wait for a bridge to accept the connection.
+const tcpDialTimeout = 5 * time.Second
+
+// tcpPort is a connection to a serial bridge, reads time out after
+// readTimeout without data like the serial port does.
+type tcpPort struct {
+	net.Conn
+	readTimeout time.Duration
+}
+
+// Read reads from the connection, returning 0 and no error on timeout.
+func (p *tcpPort) Read(b []byte) (int, error) {
+	if p.readTimeout > 0 {
+		if err := p.SetReadDeadline(time.Now().Add(p.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := p.Conn.Read(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+// dialTCP connects to the bridge at the tcp:// address, retrying up to
+// attempts times every interval.
+func dialTCP(name string, readTimeout time.Duration, attempts int, interval time.Duration) (*tcpPort, error) {
+	addr := strings.TrimPrefix(name, tcpPrefix)
+	for attempt := 1; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", addr, tcpDialTimeout)
+		if err == nil {
+			return &tcpPort{Conn: conn, readTimeout: readTimeout}, nil
+		}
+		if attempt >= attempts {
+			return nil, fmt.Errorf("Can't connect to serial bridge %s: %w", addr, err)
+		}
+
+		log.Printf("error, connecting to %s (attempt %d/%d): %v, retrying in %v", addr, attempt, attempts, err, interval)
+		time.Sleep(interval)
+	}
+}
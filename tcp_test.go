@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveBridge emulates a serial to network bridge in front of the fake
+// amplifier, returning its address.
+func serveBridge(t *testing.T, port *fakePort) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, err := port.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(buf[:n])
+			}
+		}()
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := r.ReadString('\r')
+			if err != nil {
+				return
+			}
+			port.Write([]byte(frame))
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestTCPBridge(t *testing.T) {
+	port := newFakePort()
+	t.Cleanup(func() { port.Close() })
+	cfg := testConfig(tcpPrefix + serveBridge(t, port))
+	cfg.ReadTimeout = 20 * time.Millisecond
+
+	a, err := NewAmplifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start(context.Background())
+	defer a.Close()
+
+	st, err := a.QueryAll(context.Background())
+	if err != nil {
+		t.Fatalf("QueryAll over TCP: %v", err)
+	}
+	if !st.Power || st.Source != "D1" || st.FirmwareVersion != "2.1" {
+		t.Errorf("State over TCP = %+v, want on D1 with firmware 2.1", st)
+	}
+	// Read timeouts without data aren't errors.
+	time.Sleep(50 * time.Millisecond)
+	if status, lastErr := a.connection(); status != connConnected {
+		t.Errorf("Connection = %s %s, want connected", status, lastErr)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// trimKnown is the known state field of the source trim.
+func trimKnown(source string) string {
+	return "trim " + source
+}
+
+// serveTrim replies with the trim of the source, after setting it for PUT
+// requests, see serveLevel.
+func (a *Amplifier) serveTrim(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	src, ok := a.findSource(name)
+	if !ok {
+		writeError(w, fmt.Sprintf("Unknown source: %s", name), http.StatusNotFound)
+		return
+	}
+	if !src.availableOn(a.model) {
+		writeError(w, fmt.Sprintf("Source %s isn't available on the %s", src.Name, a.model), http.StatusNotFound)
+		return
+	}
+
+	a.serveLevel(w, r, levelSetting{
+		name:  "Trim",
+		field: "trim",
+		rule:  "trim",
+		get:   GetSourceTrim(src),
+		set:   func(level int) (Command, error) { return SetSourceTrim(src, level) },
+		level: func(st AmplifierState) *int {
+			if trim, ok := st.Trims[src.Name]; ok {
+				return &trim
+			}
+			return nil
+		},
+		known: trimKnown(src.Name),
+		extra: map[string]any{"source": src.Name},
+	})
+}
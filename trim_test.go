@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestTrimCommands(t *testing.T) {
+	d2, _ := lookupSource("D2")
+	if got, want := GetSourceTrim(d2), (Command{Group: "03", Number: "05", Data: "05"}); got != want {
+		t.Errorf("GetSourceTrim(D2) = %v, want %v", got, want)
+	}
+	for _, tt := range []struct {
+		level int
+		data  string
+	}{{-6, "05-6"}, {0, "05+0"}, {3, "05+3"}, {6, "05+6"}} {
+		c, err := SetSourceTrim(d2, tt.level)
+		if want := (Command{Group: "03", Number: "06", Data: tt.data}); err != nil || c != want {
+			t.Errorf("SetSourceTrim(D2, %d) = %v, %v, want %v", tt.level, c, err, want)
+		}
+	}
+	for _, level := range []int{-7, 7} {
+		if _, err := SetSourceTrim(d2, level); err == nil {
+			t.Errorf("SetSourceTrim(D2, %d) = nil error, want out of range", level)
+		}
+	}
+
+	for _, tt := range []struct {
+		data   string
+		source string
+		level  int
+		ok     bool
+	}{
+		{"05+3", "D2", 3, true},
+		{"00-6", "A1", -6, true},
+		{"160", "USB", 0, true},
+		{"05", "", 0, false},
+		{"99+1", "", 0, false},
+		{"05+x", "", 0, false},
+	} {
+		source, level, err := parseTrim(tt.data)
+		if (err == nil) != tt.ok || source != tt.source || level != tt.level {
+			t.Errorf("parseTrim(%q) = %q, %d, %v, want %q, %d", tt.data, source, level, err, tt.source, tt.level)
+		}
+	}
+}
+
+func TestServeTrim(t *testing.T) {
+	a, port := newQueriedAmp(t)
+	srv := serve(t, a)
+
+	resp, body := request(t, srv, "PUT", "/source/D2/trim", `{"trim": -2}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("PUT /source/D2/trim = %d %s", resp.StatusCode, body)
+	}
+	var got map[string]any
+	json.Unmarshal([]byte(body), &got)
+	if want := map[string]any{"trim": -2.0, "source": "D2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PUT /source/D2/trim = %v, want %v", got, want)
+	}
+	if want := map[string]int{"D2": -2}; !reflect.DeepEqual(a.State().Trims, want) {
+		t.Errorf("Trims = %v, want %v", a.State().Trims, want)
+	}
+
+	// Known trims are served without querying the amplifier.
+	port.reset()
+	if resp, body := request(t, srv, "GET", "/source/D2/trim", ""); resp.StatusCode != 200 || len(port.commands()) != 0 {
+		t.Errorf("GET /source/D2/trim = %d %s, sent %v", resp.StatusCode, body, port.commands())
+	}
+	d1, _ := lookupSource("D1")
+	if resp, body := request(t, srv, "GET", "/source/D1/trim", ""); resp.StatusCode != 200 || !slices.Equal(port.commands(), []Command{GetSourceTrim(d1)}) {
+		t.Errorf("GET /source/D1/trim = %d %s, sent %v", resp.StatusCode, body, port.commands())
+	}
+
+	for _, tt := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/source/D2/trim", `{"trim": 7}`, 400},
+		{"/source/D2/trim", `{"level": 1}`, 400},
+		{"/source/nope/trim", `{"trim": 1}`, 404},
+	} {
+		if resp, body := request(t, srv, "PUT", tt.path, tt.body); resp.StatusCode != tt.status {
+			t.Errorf("PUT %s %s = %d %s, want %d", tt.path, tt.body, resp.StatusCode, body, tt.status)
+		}
+	}
+}
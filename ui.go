@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiPage is the web UI, served at / with -ui.
+//
+//go:embed ui/index.html
+var uiPage []byte
+
+// serveUI replies with the web UI page.
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiPage)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeUI(t *testing.T) {
+	a, _ := newTestAmp(t)
+	for _, enabled := range []bool{true, false} {
+		srv := httptest.NewServer(a.routes(false, enabled))
+		resp, body := request(t, srv, "GET", "/", "")
+		srv.Close()
+		if !enabled {
+			if resp.StatusCode != 404 {
+				t.Errorf("GET / without -ui = %d, want 404", resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != 200 || body != string(uiPage) {
+			t.Errorf("GET / = %d %.40q, want the UI page", resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("Content-Type = %q, want text/html", ct)
+		}
+	}
+}
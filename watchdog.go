@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// silent reports whether a command was sent more than the watchdog interval
+// ago without any reply since, as silence alone is expected when nothing is
+// sent, e.g. in standby without polling.
+func (a *Amplifier) silent() bool {
+	a.writeMu.Lock()
+	written := a.writeStarted
+	a.writeMu.Unlock()
+
+	lastReply := time.Unix(0, a.lastReplyTime.Load())
+	return !written.IsZero() && written.After(lastReply) && a.clock.Now().Sub(written) > a.watchdog
+}
+
+// Watchdog closes the port when the amplifier stopped replying to commands,
+// so Listen reopens it, until ctx is done. This catches half-open
+// connections which don't fail reads, polling ensures commands are sent
+// regularly enough to notice them.
+func (a *Amplifier) Watchdog(ctx context.Context) {
+	ticker := a.clock.NewTicker(a.watchdog / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		if status, _ := a.connection(); status != connConnected || !a.silent() {
+			continue
+		}
+		log.Printf("error, no reply from the amplifier within %v of the last command, reconnecting", a.watchdog)
+		a.closePort()
+	}
+}
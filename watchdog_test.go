@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+func TestWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	var ports []*fakePort
+	stubOpenPort(t, func(string, *serial.Mode) (serial.Port, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		port := newFakePort()
+		if len(ports) == 0 {
+			// A half-open connection, writes succeed but nothing's read.
+			port.onCommand(func(Command) []string { return nil })
+		}
+		ports = append(ports, port)
+		return fakeSerial{port}, nil
+	})
+	opened := func() []*fakePort {
+		mu.Lock()
+		defer mu.Unlock()
+		return ports
+	}
+
+	cfg := testConfig("/dev/ttyUSB0")
+	cfg.Watchdog = 40 * time.Millisecond
+	a, err := NewAmplifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start(context.Background())
+	t.Cleanup(func() { a.Close() })
+
+	// Silence without commands isn't a fault.
+	time.Sleep(3 * cfg.Watchdog)
+	if n := len(opened()); n != 1 {
+		t.Fatalf("Opened %d ports without commands, want 1", n)
+	}
+
+	if err := a.SendCommand(GetPowerState); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reconnection", func() bool { return len(opened()) == 2 })
+	waitFor(t, "the state", func() bool { return len(opened()[1].commands()) > 0 && a.State().Source == "D1" })
+	if got := a.metrics.reconnections.Load(); got != 1 {
+		t.Errorf("Reconnections = %d, want 1", got)
+	}
+
+	// The new port replies, so it's kept.
+	time.Sleep(3 * cfg.Watchdog)
+	if n := len(opened()); n != 2 {
+		t.Errorf("Opened %d ports with replies, want 2", n)
+	}
+}